@@ -0,0 +1,10 @@
+package main
+
+import (
+	"siody.home/om-like/internal/app/configcmd"
+	"siody.home/om-like/internal/appmain"
+)
+
+func main() {
+	appmain.RunApplicationCmd("config", configcmd.Bind, appmain.WithStaticConfig())
+}
@@ -0,0 +1,155 @@
+// Package configcmd inspects configuration files the way the servers read them,
+// so that a change can be checked before it is rolled out.
+package configcmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+	"siody.home/om-like/internal/appmain"
+	"siody.home/om-like/internal/config"
+)
+
+const usage = `usage: config [flags] <command> [args]
+
+commands:
+  print [override]      print the merged configuration
+  diff <override> <override>
+                        print the keys which differ between two override files
+  lint [override...]    validate the configuration against the schema
+
+An override argument replaces the configured override file. The default file,
+fragments, sources, environment variables and -set flags are merged as usual.`
+
+// Bind runs the command given by the command-line arguments. It is run with
+// appmain.WithStaticConfig, so that a broken configuration can be inspected.
+func Bind(p *appmain.Params, b *appmain.Bindings) error {
+	opts := p.ConfigOptions()
+	if opts == nil {
+		return errors.New("config command needs the options the configuration was read with")
+	}
+	return Run(flag.Args(), opts, os.Stdout)
+}
+
+// Run runs the command args[0] with the configuration of opts, and writes
+// the result to out.
+func Run(args []string, opts *config.Options, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	cmd, args := args[0], args[1:]
+	switch {
+	case cmd == "print" && len(args) <= 1:
+		return runPrint(args, opts, out)
+	case cmd == "diff" && len(args) == 2:
+		return runDiff(args[0], args[1], opts, out)
+	case cmd == "lint":
+		return runLint(args, opts, out)
+	}
+	return errors.New(usage)
+}
+
+func runPrint(args []string, opts *config.Options, out io.Writer) error {
+	override := ""
+	if len(args) == 1 {
+		override = args[0]
+	}
+	s, err := load(opts, override, nil)
+	if err != nil {
+		return err
+	}
+	return yaml.NewEncoder(out).Encode(s.AllSettings())
+}
+
+func runDiff(a, b string, opts *config.Options, out io.Writer) error {
+	before, err := load(opts, a, nil)
+	if err != nil {
+		return err
+	}
+	after, err := load(opts, b, nil)
+	if err != nil {
+		return err
+	}
+
+	values := func(s *config.Store) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, setting := range s.Settings() {
+			m[setting.Key] = setting.Value
+		}
+		return m
+	}
+	old, new := values(before), values(after)
+
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range new {
+		keys[k] = true
+	}
+	var changed []string
+	for k := range keys {
+		if !reflect.DeepEqual(old[k], new[k]) {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", a, b)
+	for _, k := range changed {
+		if v, ok := old[k]; ok {
+			fmt.Fprintf(out, "- %s: %v\n", k, v)
+		}
+		if v, ok := new[k]; ok {
+			fmt.Fprintf(out, "+ %s: %v\n", k, v)
+		}
+	}
+	return nil
+}
+
+func runLint(args []string, opts *config.Options, out io.Writer) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	failed := 0
+	for _, override := range args {
+		name := override
+		if name == "" {
+			name = "configuration"
+		}
+		_, err := load(opts, override, appmain.ConfigSchema())
+		if err == nil {
+			fmt.Fprintf(out, "%s: ok\n", name)
+			continue
+		}
+		failed++
+		if verr, ok := err.(*config.ValidationError); ok {
+			for _, problem := range verr.Problems {
+				fmt.Fprintf(out, "%s: %s\n", name, problem)
+			}
+		} else {
+			fmt.Fprintf(out, "%s: %s\n", name, err.Error())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d configurations are invalid", failed, len(args))
+	}
+	return nil
+}
+
+// load reads the configuration of opts, with override as the override file if
+// it is not empty, validated against schema if it is not nil.
+func load(opts *config.Options, override string, schema *config.Schema) (*config.Store, error) {
+	o := *opts
+	o.Schema = schema
+	if override != "" {
+		o.OverrideFile = override
+	}
+	return config.Load(&o)
+}
@@ -0,0 +1,90 @@
+package configcmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"siody.home/om-like/internal/config"
+)
+
+const defaultConfig = `telemetry:
+  reportingPeriod: 15s
+logging:
+  level: info
+api:
+  test:
+    httpport: 8080
+`
+
+// testOptions returns Options reading the default file of a temporary
+// directory, and a function writing files into it.
+func testOptions(t *testing.T) (*config.Options, func(name, content string) string) {
+	dir, err := ioutil.TempDir("", "configcmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("default.yaml", defaultConfig)
+	return &config.Options{
+		DefaultPaths: []string{dir},
+		DefaultName:  "default",
+		OverrideName: "none",
+	}, write
+}
+
+func TestLint(t *testing.T) {
+	opts, write := testOptions(t)
+	ok := write("ok.yaml", "api:\n  test:\n    httpport: 8081\n")
+	// Files without an extension are read as YAML too.
+	bad := write("bad", "api:\n  test:\n    httpport: http\n")
+	missing := filepath.Join(filepath.Dir(ok), "missing.yaml")
+
+	tests := []struct {
+		name     string
+		override string
+		fail     bool
+		output   string
+	}{
+		{name: "ok", override: ok, output: ok + ": ok\n"},
+		{name: "invalid", override: bad, fail: true, output: bad + ": api.test.httpport: expected int, got http\n"},
+		{name: "missing file", override: missing, fail: true, output: missing + ": fatal error reading override config file " + missing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Run([]string{"lint", tt.override}, opts, &out)
+			if tt.fail != (err != nil) {
+				t.Fatalf("expected failure %v, got %v", tt.fail, err)
+			}
+			if !strings.HasPrefix(out.String(), tt.output) {
+				t.Fatalf("expected output %q, got %q", tt.output, out.String())
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	opts, write := testOptions(t)
+	a := write("a.yaml", "api:\n  test:\n    httpport: 8081\nlogging:\n  level: debug\n")
+	b := write("b.yaml", "api:\n  test:\n    httpport: 8082\nlogging:\n  level: debug\n")
+
+	var out bytes.Buffer
+	if err := Run([]string{"diff", a, b}, opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "--- " + a + "\n+++ " + b + "\n- api.test.httpport: 8081\n+ api.test.httpport: 8082\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
@@ -2,20 +2,51 @@
 package appmain
 
 import (
+	"flag"
+
 	"github.com/sirupsen/logrus"
 	"siody.home/om-like/internal/config"
 	"siody.home/om-like/internal/logging"
 )
 
+// CmdOption configures RunApplicationCmd.
+type CmdOption func(*cmdOptions)
+
+type cmdOptions struct {
+	staticConfig bool
+}
+
+// WithStaticConfig reads the configuration once, neither validating it
+// against ConfigSchema nor watching it for changes. It is meant for commands
+// which inspect configurations, including broken ones.
+func WithStaticConfig() CmdOption {
+	return func(o *cmdOptions) {
+		o.staticConfig = true
+	}
+}
+
 // RunApplicationCmd starts and runs the given application cmd.  For use in
 // main functions to run the full application.
-func RunApplicationCmd(serviceName string, bindService Bind) {
+func RunApplicationCmd(serviceName string, bindService Bind, options ...CmdOption) {
+	var o cmdOptions
+	for _, option := range options {
+		option(&o)
+	}
 
+	opts := config.NewOptions()
+	if !o.staticConfig {
+		opts.Schema = ConfigSchema()
+	}
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 	readConfig := func() (config.View, error) {
-		return config.Read()
+		if o.staticConfig {
+			return config.Load(opts)
+		}
+		return config.ReadOptions(opts)
 	}
 
-	a, err := RunCmd(serviceName, bindService, readConfig)
+	a, err := RunCmd(serviceName, withConfigOptions(bindService, opts), readConfig)
 	if err != nil {
 		logger.Fatal(err)
 	}
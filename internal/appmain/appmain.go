@@ -3,10 +3,13 @@ package appmain
 
 import (
 	"context"
+	"flag"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"go.opencensus.io/stats/view"
@@ -16,6 +19,7 @@ import (
 	"siody.home/om-like/internal/logging"
 	"siody.home/om-like/internal/rpc"
 	"siody.home/om-like/internal/telemetry"
+	"siody.home/om-like/internal/workgroup"
 )
 
 var (
@@ -23,8 +27,22 @@ var (
 		"app":       "openmatch",
 		"component": "app.main",
 	})
+
+	// frameworkConfigPrefixes are the sections of the configuration owned by
+	// the packages of the application framework.
+	frameworkConfigPrefixes = []string{"logging", "telemetry", "api"}
+
+	appConfigFields []config.Field
 )
 
+// RegisterConfigFields adds configuration keys of the application to
+// ConfigSchema. It must be called before RunApplication, such as from init.
+// The sections of the registered keys are validated like the sections of the
+// framework; keys in other sections are not checked.
+func RegisterConfigFields(fields ...config.Field) {
+	appConfigFields = append(appConfigFields, fields...)
+}
+
 // RunApplication starts and runs the given application forever.  For use in
 // main functions to run the full application.
 func RunApplication(serviceName string, bindService Bind) {
@@ -32,11 +50,15 @@ func RunApplication(serviceName string, bindService Bind) {
 	// SIGTERM is signaled by k8s when it wants a pod to stop.
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
 
+	opts := config.NewOptions()
+	opts.Schema = ConfigSchema()
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 	readConfig := func() (config.View, error) {
-		return config.Read()
+		return config.ReadOptions(opts)
 	}
 
-	a, err := NewApplication(serviceName, bindService, readConfig, net.Listen)
+	a, err := NewApplication(serviceName, withConfigOptions(bindService, opts), readConfig, net.Listen)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -49,13 +71,40 @@ func RunApplication(serviceName string, bindService Bind) {
 	logger.Info("Application stopped successfully.")
 }
 
+// ConfigSchema returns the schema of the configuration keys read by the
+// packages of the application framework, and of the keys registered with
+// RegisterConfigFields. Unknown keys are only rejected in the sections of
+// these keys.
+func ConfigSchema() *config.Schema {
+	var fields []config.Field
+	fields = append(fields, logging.ConfigFields...)
+	fields = append(fields, telemetry.ConfigFields...)
+	fields = append(fields, rpc.ConfigFields...)
+	fields = append(fields, appConfigFields...)
+
+	prefixes := append([]string{}, frameworkConfigPrefixes...)
+	for _, f := range appConfigFields {
+		prefixes = append(prefixes, strings.SplitN(f.Key, ".", 2)[0])
+	}
+	return config.NewSchema(fields...).WithOwnedPrefixes(prefixes...)
+}
+
 // Bind is a function which starts an application, and binds it to serving.
 type Bind func(p *Params, b *Bindings) error
 
+// withConfigOptions passes the options of the configuration to bindService.
+func withConfigOptions(bindService Bind, opts *config.Options) Bind {
+	return func(p *Params, b *Bindings) error {
+		p.configOptions = opts
+		return bindService(p, b)
+	}
+}
+
 // Params are inputs to starting an application.
 type Params struct {
-	config      config.View
-	serviceName string
+	config        config.View
+	configOptions *config.Options
+	serviceName   string
 }
 
 // Config provides the configuration for the application.
@@ -63,6 +112,12 @@ func (p *Params) Config() config.View {
 	return p.config
 }
 
+// ConfigOptions are the options the configuration was read with, or nil if
+// the configuration was not read from files.
+func (p *Params) ConfigOptions() *config.Options {
+	return p.configOptions
+}
+
 // ServiceName is a name for the currently running binary specified by
 // RunApplication.
 func (p *Params) ServiceName() string {
@@ -101,14 +156,39 @@ func (b *Bindings) AddHandleFunc(httpHandler rpc.HTTPHandler) {
 	b.sp.AddHandleFunc(httpHandler)
 }
 
+// AddGrpcHandleFunc adds gRPC services to the server which is starting. They
+// are served on the HTTP port, or on api.<service>.grpcport if it is set.
+func (b *Bindings) AddGrpcHandleFunc(grpcHandler rpc.GRPCHandler) {
+	b.sp.AddGrpcHandleFunc(grpcHandler)
+}
+
+// AddGrpcProxyHandleFunc adds the JSON/REST gateway of a gRPC service, served
+// at "/" of the HTTP port.
+func (b *Bindings) AddGrpcProxyHandleFunc(grpcProxyHandler rpc.GRPCProxyHandler) {
+	b.sp.AddGrpcProxyHandleFunc(grpcProxyHandler)
+}
+
+// SetAuthorizer sets the rpc.Authorizer of all requests to the server.
+func (b *Bindings) SetAuthorizer(authorizer rpc.Authorizer) {
+	b.sp.SetAuthorizer(authorizer)
+}
+
 // TelemetryHandle adds a handler to the mux for serving debug info and metrics.
+// It is the mux of api.<service>.adminport if that is set.
 func (b *Bindings) TelemetryHandle(pattern string, handler http.Handler) {
-	b.sp.ServeMux.Handle(pattern, handler)
+	b.sp.TelemetryMux().Handle(pattern, handler)
 }
 
 // TelemetryHandleFunc adds a handlerfunc to the mux for serving debug info and metrics.
+// It is the mux of api.<service>.adminport if that is set.
 func (b *Bindings) TelemetryHandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	b.sp.ServeMux.HandleFunc(pattern, handler)
+	b.sp.TelemetryMux().HandleFunc(pattern, handler)
+}
+
+// HasAdminPort returns true if the telemetry handlers are served on
+// api.<service>.adminport.
+func (b *Bindings) HasAdminPort() bool {
+	return b.sp.HasAdminPort()
 }
 
 // AddCloser specifies a function to be called when the application is being
@@ -158,6 +238,13 @@ func NewApplication(serviceName string, bindService Bind, getCfg func() (config.
 		a:  a,
 		sp: sp,
 	}
+	if c, ok := cfg.(io.Closer); ok {
+		b.AddCloserErr(c.Close)
+	}
+	// Apply log level and format changes without a restart.
+	b.AddCloser(config.Watch(cfg, "logging", func(_, v config.View) {
+		logging.ConfigureLogging(v)
+	}))
 
 	err = telemetry.Setup(p, b)
 	if err != nil {
@@ -165,6 +252,9 @@ func NewApplication(serviceName string, bindService Bind, getCfg func() (config.
 		_ = surpressedErr
 		return nil, err
 	}
+	b.RegisterViews(config.OpenCensusViews...)
+	b.RegisterViews(rpc.OpenCensusViews...)
+	b.RegisterViews(workgroup.OpenCensusViews...)
 
 	err = bindService(p, b)
 	if err != nil {
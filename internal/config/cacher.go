@@ -1,8 +1,13 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"sync"
 	"time"
+
+	"go.opencensus.io/tag"
 )
 
 // Cacher is used to cache the construction of an object, such as a connection.
@@ -12,11 +17,22 @@ import (
 type Cacher struct {
 	cfg         View
 	newInstance NewInstanceFunc
+	name        string
+	ctx         context.Context
+	background  bool
+	grace       time.Duration
 	m           sync.Mutex
 
 	r *viewChangeDetector
 	v interface{}
 	c func()
+
+	// rebuilding is true while a background rebuild runs, retryAfter delays
+	// the next background rebuild after a failure, and generation counts the
+	// resets, so that a rebuild started before a reset is discarded.
+	rebuilding bool
+	retryAfter time.Time
+	generation int
 }
 
 // NewInstanceFunc is used by the cacher to create a new value given the config.
@@ -24,14 +40,56 @@ type Cacher struct {
 // ForceReset is called.
 type NewInstanceFunc func(cfg View) (interface{}, func(), error)
 
+// CacherOption configures a Cacher.
+type CacherOption func(*Cacher)
+
+// WithCacherName names the Cacher in its metrics and logs.
+func WithCacherName(name string) CacherOption {
+	return func(c *Cacher) {
+		c.name = name
+	}
+}
+
+// WithBackgroundRebuild makes Get return the cached object when a config
+// change is seen, and build the new object in the background. Once it is
+// built, the new object replaces the old one, which is closed after grace so
+// that callers still using it can finish. If the build fails, the old object
+// stays cached and the build is retried later.
+//
+// A background build may run at the same time as a build in Get after
+// ForceReset, so newInstance must be safe for concurrent use.
+func WithBackgroundRebuild(grace time.Duration) CacherOption {
+	return func(c *Cacher) {
+		c.background = true
+		c.grace = grace
+	}
+}
+
+const (
+	// rebuildRetry is how long a Cacher waits after a failed background
+	// rebuild before it tries again.
+	rebuildRetry = time.Second
+)
+
 // NewCacher returns a cacher which uses cfg to detect relevant changes, and
 // newInstance to construct the object when nessisary.  newInstance MUST use the
 // provided View when constructing the object.
-func NewCacher(cfg View, newInstance NewInstanceFunc) *Cacher {
-	return &Cacher{
+func NewCacher(cfg View, newInstance NewInstanceFunc, opts ...CacherOption) *Cacher {
+	c := &Cacher{
 		cfg:         cfg,
 		newInstance: newInstance,
+		name:        "default",
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	ctx, err := tag.New(context.Background(), tag.Upsert(keyCacher, c.name))
+	if err != nil {
+		logger.WithError(err).Warningf("cannot tag metrics of cacher %s", c.name)
+		ctx = context.Background()
+	}
+	c.ctx = ctx
+	return c
 }
 
 // Get returns the cached object if possible, otherwise it calls newInstance to
@@ -40,16 +98,26 @@ func NewCacher(cfg View, newInstance NewInstanceFunc) *Cacher {
 // changed. If they have, the cache is invalidated, and a new object is
 // constructed. If newInstance returns an error, Get returns that error and the
 // object will not be cached or returned.
+//
+// With WithBackgroundRebuild, only the first object is constructed by Get.
 func (c *Cacher) Get() (interface{}, error) {
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	if c.r != nil && c.background {
+		if !c.rebuilding && time.Now().After(c.retryAfter) && c.r.hasChanges() {
+			c.rebuilding = true
+			go c.rebuild(c.generation)
+		}
+		return c.v, nil
+	}
+
 	if c.r == nil || c.r.hasChanges() {
 		c.locklessReset()
 
 		c.r = newViewChangeDetector(c.cfg)
 		var err error
-		c.v, c.c, err = c.newInstance(c.r)
+		c.v, c.c, err = c.build(c.r)
 		if err != nil {
 			c.locklessReset()
 			return nil, err
@@ -59,6 +127,69 @@ func (c *Cacher) Get() (interface{}, error) {
 	return c.v, nil
 }
 
+// GetInto is Get which stores the object in out, a pointer to a variable of
+// the type of the object or of an interface it implements, such as
+//
+//	var client *http.Client
+//	err := cacher.GetInto(&client)
+//
+// It returns an error rather than panicking if the object has another type.
+func (c *Cacher) GetInto(out interface{}) error {
+	dst := reflect.ValueOf(out)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("cacher %s: expected a non-nil pointer, got %T", c.name, out)
+	}
+	v, err := c.Get()
+	if err != nil {
+		return err
+	}
+	dst = dst.Elem()
+	if v == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if src := reflect.ValueOf(v); src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	return fmt.Errorf("cacher %s: cannot store %T in %s", c.name, v, dst.Type())
+}
+
+func (c *Cacher) build(r *viewChangeDetector) (interface{}, func(), error) {
+	start := time.Now()
+	v, closer, err := c.newInstance(r)
+	recordRebuild(c.ctx, start, err)
+	return v, closer, err
+}
+
+// rebuild builds a new object without holding the lock, and replaces the
+// cached object with it unless the Cacher was reset since generation.
+func (c *Cacher) rebuild(generation int) {
+	r := newViewChangeDetector(c.cfg)
+	v, closer, err := c.build(r)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.rebuilding = false
+	if err != nil {
+		c.retryAfter = time.Now().Add(rebuildRetry)
+		logger.WithError(err).Warningf("cannot rebuild the object of cacher %s, keeping the old one", c.name)
+		return
+	}
+	if generation != c.generation {
+		if closer != nil {
+			go closer()
+		}
+		return
+	}
+
+	old := c.c
+	c.r, c.v, c.c = r, v, closer
+	if old != nil {
+		time.AfterFunc(c.grace, old)
+	}
+}
+
 // ForceReset causes Cacher to forget the cached object.  The next call to Get
 // will again use newInstance to create a new object.
 func (c *Cacher) ForceReset() {
@@ -74,6 +205,7 @@ func (c *Cacher) locklessReset() {
 	c.c = nil
 	c.r = nil
 	c.v = nil
+	c.generation++
 }
 
 // Remember each value as it is read, and can detect if a value has been changed
@@ -88,6 +220,12 @@ type viewChangeDetector struct {
 	getStringSlice map[string][]string
 	getBool        map[string]bool
 	getDuration    map[string]time.Duration
+
+	getStringMap       map[string]map[string]interface{}
+	getStringMapString map[string]map[string]string
+	getIntSlice        map[string][]int
+	getTime            map[string]time.Time
+	getSizeInBytes     map[string]uint
 }
 
 func newViewChangeDetector(cfg View) *viewChangeDetector {
@@ -101,6 +239,12 @@ func newViewChangeDetector(cfg View) *viewChangeDetector {
 		getStringSlice: make(map[string][]string),
 		getBool:        make(map[string]bool),
 		getDuration:    make(map[string]time.Duration),
+
+		getStringMap:       make(map[string]map[string]interface{}),
+		getStringMapString: make(map[string]map[string]string),
+		getIntSlice:        make(map[string][]int),
+		getTime:            make(map[string]time.Time),
+		getSizeInBytes:     make(map[string]uint),
 	}
 }
 
@@ -152,6 +296,36 @@ func (r *viewChangeDetector) GetDuration(k string) time.Duration {
 	return v
 }
 
+func (r *viewChangeDetector) GetStringMap(k string) map[string]interface{} {
+	v := r.cfg.GetStringMap(k)
+	r.getStringMap[k] = v
+	return v
+}
+
+func (r *viewChangeDetector) GetStringMapString(k string) map[string]string {
+	v := r.cfg.GetStringMapString(k)
+	r.getStringMapString[k] = v
+	return v
+}
+
+func (r *viewChangeDetector) GetIntSlice(k string) []int {
+	v := r.cfg.GetIntSlice(k)
+	r.getIntSlice[k] = v
+	return v
+}
+
+func (r *viewChangeDetector) GetTime(k string) time.Time {
+	v := r.cfg.GetTime(k)
+	r.getTime[k] = v
+	return v
+}
+
+func (r *viewChangeDetector) GetSizeInBytes(k string) uint {
+	v := r.cfg.GetSizeInBytes(k)
+	r.getSizeInBytes[k] = v
+	return v
+}
+
 func (r *viewChangeDetector) hasChanges() bool {
 	for k, v := range r.isSet {
 		if r.cfg.IsSet(k) != v {
@@ -208,5 +382,35 @@ func (r *viewChangeDetector) hasChanges() bool {
 		}
 	}
 
+	for k, v := range r.getStringMap {
+		if !reflect.DeepEqual(r.cfg.GetStringMap(k), v) {
+			return true
+		}
+	}
+
+	for k, v := range r.getStringMapString {
+		if !reflect.DeepEqual(r.cfg.GetStringMapString(k), v) {
+			return true
+		}
+	}
+
+	for k, v := range r.getIntSlice {
+		if !reflect.DeepEqual(r.cfg.GetIntSlice(k), v) {
+			return true
+		}
+	}
+
+	for k, v := range r.getTime {
+		if !r.cfg.GetTime(k).Equal(v) {
+			return true
+		}
+	}
+
+	for k, v := range r.getSizeInBytes {
+		if r.cfg.GetSizeInBytes(k) != v {
+			return true
+		}
+	}
+
 	return false
 }
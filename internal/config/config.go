@@ -3,56 +3,253 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 // Read sets default to a viper instance and read user config to override these defaults.
-func Read() (*viper.Viper, error) {
-	var err error
-	// read configs from config/default/matchmaker_config_default.yaml
+// The returned Store reloads itself when the configuration files change.
+func Read() (*Store, error) {
+	return ReadOptions(NewOptions())
+}
+
+// ReadOptions is Read with the file locations and overlays given by o.
+func ReadOptions(o *Options) (*Store, error) {
+	sources, err := o.sources()
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(func() (*snapshot, error) {
+		return load(o, sources)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Look for updates to the config; in Kubernetes, this is implemented using
+	// a ConfigMap that is written to the matchmaker_config_override.yaml file, which is
+	// what the Open Match components using Viper monitor for changes.
+	// More details about Open Match's use of Kubernetes ConfigMaps at:
+	// https://open-match.dev/open-match/issues/42
+	err = s.watch()
+	if err != nil {
+		return nil, fmt.Errorf("fatal error watching config files, desc: %s", err.Error())
+	}
+	for _, src := range sources {
+		if err = src.Watch(s.stop, s.scheduleReload); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("fatal error watching config source %s, desc: %s", src.Name(), err.Error())
+		}
+	}
+	return s, nil
+}
+
+// Load reads the configuration like ReadOptions, but does not watch it. It is
+// meant for tools which inspect a configuration once.
+func Load(o *Options) (*Store, error) {
+	sources, err := o.sources()
+	if err != nil {
+		return nil, err
+	}
+	return newStore(func() (*snapshot, error) {
+		return load(o, sources)
+	})
+}
+
+// load merges the layers of the configuration, in order of increasing
+// precedence: the default file, the override file, the fragments, sources,
+// environment variables and command-line flags. Secret references are resolved, and the
+// result is validated against the schema of o.
+func load(o *Options, sources []Source) (*snapshot, error) {
+	snap := &snapshot{}
+	l := newLayering()
+
 	// matchmaker_config_default provides default values for all of the possible tunnable parameters in Open Match
-	dcfg := viper.New()
-	dcfg.SetConfigType("yaml")
-	dcfg.AddConfigPath(".")
-	// The config path needs to be the same as the volumeMount path defined via helm
-	dcfg.AddConfigPath("/app/config/default")
-	dcfg.SetConfigName("matchmaker_config_default")
-	err = dcfg.ReadInConfig()
+	dcfg, err := findFile(o.DefaultPaths, o.DefaultName)
 	if err != nil {
 		return nil, fmt.Errorf("fatal error reading default config file, desc: %s", err.Error())
 	}
+	snap.files = append(snap.files, dcfg.ConfigFileUsed())
+	if err = l.merge(LayerDefault, dcfg.AllSettings()); err != nil {
+		return nil, err
+	}
 
-	// read configs from config/override/matchmaker_config_default.yaml
 	// matchmaker_config_override overrides default values specified in matchmaker_config_default
-	cfg := viper.New()
+	if err = loadOverride(o, snap, l); err != nil {
+		return nil, err
+	}
+
+	if o.FragmentsDir != "" {
+		snap.dirs = append(snap.dirs, o.FragmentsDir)
+		fragments, err := listFragments(o.FragmentsDir)
+		if err != nil {
+			return nil, fmt.Errorf("fatal error listing config fragments, desc: %s", err.Error())
+		}
+		for _, f := range fragments {
+			settings, err := readFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("fatal error reading config fragment %s, desc: %s", f, err.Error())
+			}
+			snap.files = append(snap.files, f)
+			if err = l.merge(fragmentLayer(f), settings); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	// set defaults for cfg using settings in dcfg
-	for k, v := range dcfg.AllSettings() {
-		cfg.SetDefault(k, v)
+	for _, src := range sources {
+		settings, err := src.Load()
+		if err != nil {
+			return nil, fmt.Errorf("fatal error reading config source %s, desc: %s", src.Name(), err.Error())
+		}
+		if err = l.merge(sourceLayer(src), settings); err != nil {
+			return nil, err
+		}
 	}
 
-	cfg.SetConfigType("yaml")
-	cfg.AddConfigPath(".")
-	// The config path needs to be the same as the volumeMountPath defined via helm
-	cfg.AddConfigPath("/app/config/override")
-	cfg.SetConfigName("matchmaker_config_override")
-	err = cfg.ReadInConfig()
+	if err = l.mergeFlat(LayerEnv, envSettings(o.EnvPrefix, l.keys())); err != nil {
+		return nil, err
+	}
+	flags, err := o.flagSettings()
 	if err != nil {
-		return nil, fmt.Errorf("fatal error reading override config file, desc: %s", err.Error())
+		return nil, err
+	}
+	if err = l.mergeFlat(LayerFlag, flags); err != nil {
+		return nil, err
 	}
 
-	// Look for updates to the config; in Kubernetes, this is implemented using
-	// a ConfigMap that is written to the matchmaker_config_override.yaml file, which is
-	// what the Open Match components using Viper monitor for changes.
-	// More details about Open Match's use of Kubernetes ConfigMaps at:
-	// https://open-match.dev/open-match/issues/42
-	cfg.WatchConfig() // Watch and re-read config file.
-	// Write a log when the configuration changes.
-	cfg.OnConfigChange(func(event fsnotify.Event) {
-		log.Printf("Server configuration changed, operation: %v, filename: %s", event.Op, event.Name)
-	})
-	return cfg, nil
+	resolved, secrets, secretFiles, err := resolveSecrets(flatten("", l.settings))
+	if err != nil {
+		return nil, err
+	}
+	snap.files = append(snap.files, secretFiles...)
+	snap.secrets = secrets
+	resolvedSettings := nest(resolved)
+
+	if o.Schema != nil {
+		if err = o.Schema.validate(resolvedSettings, secrets); err != nil {
+			return nil, err
+		}
+	}
+
+	snap.raw, err = l.viper()
+	if err != nil {
+		return nil, err
+	}
+	snap.Viper, err = newViper(resolvedSettings)
+	if err != nil {
+		return nil, err
+	}
+	snap.origins = l.origins
+	return snap, nil
+}
+
+// loadOverride merges the override file, which is optional unless
+// o.OverrideFile is set.
+func loadOverride(o *Options, snap *snapshot, l *layering) error {
+	if o.OverrideFile != "" {
+		settings, err := readFile(o.OverrideFile)
+		if err != nil {
+			return fmt.Errorf("fatal error reading override config file %s, desc: %s", o.OverrideFile, err.Error())
+		}
+		snap.files = append(snap.files, o.OverrideFile)
+		return l.merge(LayerOverride, settings)
+	}
+
+	ocfg, err := findFile(o.OverridePaths, o.OverrideName)
+	if _, notFound := err.(viper.ConfigFileNotFoundError); notFound {
+		logger.Debugf("no override config file %s found", o.OverrideName)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("fatal error reading override config file, desc: %s", err.Error())
+	}
+	snap.files = append(snap.files, ocfg.ConfigFileUsed())
+	return l.merge(LayerOverride, ocfg.AllSettings())
+}
+
+// findFile reads the first YAML file called name in paths.
+func findFile(paths []string, name string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	for _, p := range paths {
+		v.AddConfigPath(p)
+	}
+	v.SetConfigName(name)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return v.AllSettings(), nil
+}
+
+// listFragments returns the YAML files of dir in lexical order. Hidden files
+// are skipped, which also skips the ..data directory of Kubernetes ConfigMaps.
+func listFragments(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if !isFragment(path) {
+			continue
+		}
+		// Follow symlinks, ConfigMap entries are symlinks into ..data.
+		if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+			continue
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isFragment(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// fragmentLayer returns the layer of a fragment of the configuration
+// directory, "fragment:<file name>". Fragments are merged between
+// LayerOverride and LayerEnv.
+func fragmentLayer(path string) Layer {
+	return Layer("fragment:" + filepath.Base(path))
+}
+
+// envSettings returns the values of the environment variables overriding keys.
+// The variable of a key is the upper-cased key with dots replaced by
+// underscores, after prefix and an underscore. For example, OM_API_TEST_HTTPPORT
+// overrides api.test.httpport. Only keys which are already set by a lower
+// layer can be overridden.
+func envSettings(prefix string, keys []string) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if prefix == "" {
+		return settings
+	}
+	for _, k := range keys {
+		name := strings.ToUpper(prefix + "_" + strings.Replace(k, ".", "_", -1))
+		if v, ok := os.LookupEnv(name); ok {
+			settings[k] = v
+		}
+	}
+	return settings
 }
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Redacted replaces the values of secrets in Settings.
+const Redacted = "[redacted]"
+
+// Setting describes the effective value of a leaf key.
+type Setting struct {
+	Key string `json:"key" yaml:"key"`
+	// Value is Redacted for secrets.
+	Value interface{} `json:"value" yaml:"value"`
+	// Layer set the value.
+	Layer Layer `json:"layer" yaml:"layer"`
+	// Changed is when the value last changed, or when the Store started.
+	Changed time.Time `json:"changed" yaml:"changed"`
+	Secret  bool      `json:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// Settings returns the effective leaf settings, sorted by key.
+func (s *Store) Settings() []Setting {
+	snap := s.snapshot()
+	flat := flatten("", snap.AllSettings())
+	settings := make([]Setting, 0, len(flat))
+	for k, v := range flat {
+		if snap.secrets[k] {
+			v = Redacted
+		}
+		settings = append(settings, Setting{
+			Key:     k,
+			Value:   v,
+			Layer:   snap.origins[k],
+			Changed: snap.changed[k],
+			Secret:  snap.secrets[k],
+		})
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].Key < settings[j].Key
+	})
+	return settings
+}
+
+// Version returns the active version of the configuration.
+func (s *Store) Version() Version {
+	return s.snapshot().version
+}
+
+// changedSince returns when each leaf key of next last changed, given prev
+// was active before it. prev may be nil.
+func changedSince(prev, next *snapshot, now time.Time) map[string]time.Time {
+	var before map[string]interface{}
+	if prev != nil {
+		before = flatten("", prev.resolvedSettings())
+	}
+	changed := map[string]time.Time{}
+	for k, v := range flatten("", next.resolvedSettings()) {
+		if old, ok := before[k]; ok && reflect.DeepEqual(old, v) {
+			if t, ok := prev.changed[k]; ok {
+				changed[k] = t
+				continue
+			}
+		}
+		changed[k] = now
+	}
+	return changed
+}
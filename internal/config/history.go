@@ -0,0 +1,140 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// historySize is the number of applied versions a Store remembers.
+	historySize = 10
+)
+
+// Version describes one configuration applied by a Store.
+type Version struct {
+	// Number increases by one with each applied configuration.
+	Number int `json:"number"`
+	// Hash is the SHA-256 of the merged settings. Resolved secrets are
+	// included by their own SHA-256.
+	Hash string `json:"hash"`
+	// Applied is when the configuration became active.
+	Applied time.Time `json:"applied"`
+	// Cause is why the configuration was applied: startup, reload or a
+	// rollback.
+	Cause string `json:"cause"`
+}
+
+// Rejection describes a reload which was rejected because the configuration
+// could not be read or was invalid.
+type Rejection struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// History describes the configurations applied by a Store.
+type History struct {
+	// Versions are the most recently applied versions, oldest first. The
+	// last one is active.
+	Versions []Version `json:"versions"`
+	// LastRejection is the most recent rejected reload, if any.
+	LastRejection *Rejection `json:"lastRejection,omitempty"`
+}
+
+// hashSnapshot returns the SHA-256 of the JSON encoding of the settings of
+// snap, which orders map keys. Secrets are hashed separately, so the hash
+// changes when a secret does, but does not reveal it.
+func hashSnapshot(snap *snapshot) string {
+	secrets := make(map[string]string, len(snap.secrets))
+	for k := range snap.secrets {
+		secrets[k] = hashString(snap.GetString(k))
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"settings": snap.AllSettings(),
+		"secrets":  secrets,
+	})
+	if err != nil {
+		b = []byte(fmt.Sprint(snap.AllSettings(), secrets))
+	}
+	return hashString(string(b))
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// History returns the recently applied versions of the configuration.
+func (s *Store) History() History {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	h := History{
+		Versions: make([]Version, len(s.history)),
+	}
+	for i, snap := range s.history {
+		h.Versions[i] = snap.version
+	}
+	if s.lastRejection != nil {
+		r := *s.lastRejection
+		h.LastRejection = &r
+	}
+	return h
+}
+
+// Rollback makes the version number of the history active again, as a new
+// version. The next change of the configuration files replaces it as usual.
+func (s *Store) Rollback(number int) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	var target *snapshot
+	s.m.RLock()
+	for _, snap := range s.history {
+		if snap.version.Number == number {
+			target = snap
+		}
+	}
+	s.m.RUnlock()
+	if target == nil {
+		return fmt.Errorf("configuration version %d is not in the history", number)
+	}
+
+	next := *target
+	logger.Warningf("Rolling configuration back to version %d", number)
+	s.apply(&next, fmt.Sprintf("rollback to %d", number))
+	return nil
+}
+
+// reject records a reload which was not applied.
+func (s *Store) reject(err error) {
+	logger.WithError(err).Error("cannot reload configuration, keeping the current configuration")
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lastRejection = &Rejection{
+		Time:  time.Now(),
+		Error: err.Error(),
+	}
+}
+
+// pushHistory makes snap the current version, following prev. s.m must be
+// held.
+func (s *Store) pushHistory(prev, snap *snapshot, cause string) {
+	number := 1
+	if len(s.history) > 0 {
+		number = s.history[len(s.history)-1].version.Number + 1
+	}
+	now := time.Now()
+	snap.version = Version{
+		Number:  number,
+		Hash:    hashSnapshot(snap),
+		Applied: now,
+		Cause:   cause,
+	}
+	snap.changed = changedSince(prev, snap, now)
+	s.history = append(s.history, snap)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+}
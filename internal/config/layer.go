@@ -0,0 +1,140 @@
+package config
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Layer identifies where an effective configuration value came from. Besides
+// the constants below, each file of the configuration directory is a layer of
+// its own; see fragmentLayer and sourceLayer.
+type Layer string
+
+const (
+	// LayerDefault is the default configuration file.
+	LayerDefault Layer = "default"
+	// LayerOverride is the override configuration file.
+	LayerOverride Layer = "override"
+	// LayerEnv is the environment variables.
+	LayerEnv Layer = "env"
+	// LayerFlag is the command-line flags.
+	LayerFlag Layer = "flag"
+)
+
+// layering merges settings, remembering which layer set each key last.
+type layering struct {
+	settings map[string]interface{}
+	origins  map[string]Layer
+}
+
+func newLayering() *layering {
+	return &layering{
+		settings: map[string]interface{}{},
+		origins:  map[string]Layer{},
+	}
+}
+
+// merge deep-merges nested settings over the settings merged so far. Unlike
+// viper's MergeConfigMap, a value may replace a value of a different type, as
+// environment variables and flags are always strings.
+func (l *layering) merge(layer Layer, settings map[string]interface{}) error {
+	mergeSettings(l.settings, settings)
+	for k := range flatten("", settings) {
+		l.origins[k] = layer
+	}
+	return nil
+}
+
+// viper returns a new viper instance holding the merged settings.
+func (l *layering) viper() (*viper.Viper, error) {
+	return newViper(l.settings)
+}
+
+func newViper(settings map[string]interface{}) (*viper.Viper, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func mergeSettings(dst, src map[string]interface{}) {
+	for k, v := range src {
+		k = strings.ToLower(k)
+		if isMap(v) {
+			next, ok := dst[k].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				dst[k] = next
+			}
+			mergeSettings(next, cast.ToStringMap(v))
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// mergeFlat merges settings given as dotted keys.
+func (l *layering) mergeFlat(layer Layer, settings map[string]interface{}) error {
+	return l.merge(layer, nest(settings))
+}
+
+// keys returns the sorted leaf keys merged so far.
+func (l *layering) keys() []string {
+	keys := make([]string, 0, len(l.origins))
+	for k := range l.origins {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nest turns dotted keys into nested settings. It is the inverse of flatten.
+func nest(flat map[string]interface{}) map[string]interface{} {
+	nested := map[string]interface{}{}
+	for k, v := range flat {
+		path := strings.Split(strings.ToLower(k), ".")
+		m := nested
+		for _, p := range path[:len(path)-1] {
+			next, ok := m[p].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				m[p] = next
+			}
+			m = next
+		}
+		m[path[len(path)-1]] = v
+	}
+	return nested
+}
+
+// flatten returns the leaf values of nested settings by their dotted,
+// lower-cased keys.
+func flatten(prefix string, settings map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	for k, v := range settings {
+		key := strings.ToLower(k)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if isMap(v) {
+			for fk, fv := range flatten(key, cast.ToStringMap(v)) {
+				flat[fk] = fv
+			}
+			continue
+		}
+		flat[key] = v
+	}
+	return flat
+}
+
+func isMap(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		return true
+	}
+	return false
+}
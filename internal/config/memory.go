@@ -0,0 +1,167 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// Memory is an in-memory Mutable configuration which is safe for concurrent
+// use. It is intended for tests. Set notifies the subscribers of Watch.
+type Memory struct {
+	m       sync.RWMutex
+	values  map[string]interface{}
+	subs    map[int]*memorySubscription
+	nextSub int
+}
+
+type memorySubscription struct {
+	key string
+	fn  ChangeFunc
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{
+		values: map[string]interface{}{},
+		subs:   map[int]*memorySubscription{},
+	}
+}
+
+// Set sets the value of k. Setting a map sets the keys below k.
+func (m *Memory) Set(k string, v interface{}) {
+	k = strings.ToLower(k)
+	m.m.Lock()
+	old := &Memory{values: m.values}
+	values := make(map[string]interface{}, len(m.values))
+	for ek, ev := range m.values {
+		// Drop the keys replaced by v, and the values on the path to k.
+		if ek == k || strings.HasPrefix(ek, k+".") || strings.HasPrefix(k, ek+".") {
+			continue
+		}
+		values[ek] = ev
+	}
+	if isMap(v) {
+		for fk, fv := range flatten(k, cast.ToStringMap(v)) {
+			values[fk] = fv
+		}
+	} else {
+		values[k] = v
+	}
+	m.values = values
+	new := &Memory{values: values}
+	subs := make([]*memorySubscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		subs = append(subs, sub)
+	}
+	m.m.Unlock()
+
+	for _, sub := range subs {
+		if !reflect.DeepEqual(old.subtree(sub.key), new.subtree(sub.key)) {
+			sub.fn(old, new)
+		}
+	}
+}
+
+// Watch implements Watchable. fn is called by Set.
+func (m *Memory) Watch(key string, fn ChangeFunc) (cancel func()) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	id := m.nextSub
+	m.nextSub++
+	m.subs[id] = &memorySubscription{
+		key: strings.ToLower(key),
+		fn:  fn,
+	}
+	return func() {
+		m.m.Lock()
+		defer m.m.Unlock()
+		delete(m.subs, id)
+	}
+}
+
+// subtree returns the leaf values at or below k, or all values if k is empty.
+func (m *Memory) subtree(k string) map[string]interface{} {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	sub := map[string]interface{}{}
+	for ek, ev := range m.values {
+		if k == "" || ek == k || strings.HasPrefix(ek, k+".") {
+			sub[ek] = ev
+		}
+	}
+	return sub
+}
+
+func (m *Memory) get(k string) interface{} {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return m.values[strings.ToLower(k)]
+}
+
+// IsSet implements View. It is true for keys with a value, and for keys with
+// values below them.
+func (m *Memory) IsSet(k string) bool {
+	k = strings.ToLower(k)
+	m.m.RLock()
+	defer m.m.RUnlock()
+	for ek := range m.values {
+		if ek == k || strings.HasPrefix(ek, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetString implements View.
+func (m *Memory) GetString(k string) string { return cast.ToString(m.get(k)) }
+
+// GetInt implements View.
+func (m *Memory) GetInt(k string) int { return cast.ToInt(m.get(k)) }
+
+// GetInt64 implements View.
+func (m *Memory) GetInt64(k string) int64 { return cast.ToInt64(m.get(k)) }
+
+// GetFloat64 implements View.
+func (m *Memory) GetFloat64(k string) float64 { return cast.ToFloat64(m.get(k)) }
+
+// GetStringSlice implements View.
+func (m *Memory) GetStringSlice(k string) []string { return cast.ToStringSlice(m.get(k)) }
+
+// GetBool implements View.
+func (m *Memory) GetBool(k string) bool { return cast.ToBool(m.get(k)) }
+
+// GetDuration implements View.
+func (m *Memory) GetDuration(k string) time.Duration { return cast.ToDuration(m.get(k)) }
+
+// GetStringMap implements View.
+func (m *Memory) GetStringMap(k string) map[string]interface{} {
+	if v := m.get(k); v != nil {
+		return cast.ToStringMap(v)
+	}
+	k = strings.ToLower(k)
+	sub := map[string]interface{}{}
+	for ek, ev := range m.subtree(k) {
+		if ek != k {
+			sub[strings.TrimPrefix(ek, k+".")] = ev
+		}
+	}
+	return nest(sub)
+}
+
+// GetStringMapString implements View.
+func (m *Memory) GetStringMapString(k string) map[string]string {
+	return cast.ToStringMapString(m.GetStringMap(k))
+}
+
+// GetIntSlice implements View.
+func (m *Memory) GetIntSlice(k string) []int { return cast.ToIntSlice(m.get(k)) }
+
+// GetTime implements View.
+func (m *Memory) GetTime(k string) time.Time { return cast.ToTime(m.get(k)) }
+
+// GetSizeInBytes implements View.
+func (m *Memory) GetSizeInBytes(k string) uint { return parseSizeInBytes(cast.ToString(m.get(k))) }
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	keyCacher = tag.MustNewKey("cacher")
+
+	mRebuilds        = stats.Int64("config/cacher_rebuilds", "Number of objects built by a Cacher", stats.UnitDimensionless)
+	mRebuildFailures = stats.Int64("config/cacher_rebuild_failures", "Number of objects a Cacher failed to build", stats.UnitDimensionless)
+	mRebuildDuration = stats.Float64("config/cacher_rebuild_duration", "Duration of building an object of a Cacher", stats.UnitMilliseconds)
+
+	rebuildsView = &view.View{
+		Measure:     mRebuilds,
+		Name:        "config/cacher_rebuilds",
+		Description: "Number of objects built by a Cacher",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCacher},
+	}
+	rebuildFailuresView = &view.View{
+		Measure:     mRebuildFailures,
+		Name:        "config/cacher_rebuild_failures",
+		Description: "Number of objects a Cacher failed to build",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCacher},
+	}
+	rebuildDurationView = &view.View{
+		Measure:     mRebuildDuration,
+		Name:        "config/cacher_rebuild_duration",
+		Description: "Distribution of the duration of building an object of a Cacher",
+		Aggregation: view.Distribution(0.01, 0.05, 0.1, 0.3, 0.6, 0.8, 1, 2, 3, 4, 5, 6, 8, 10, 13, 16, 20, 25, 30, 40, 50, 65, 80, 100, 130, 160, 200, 250, 300, 400, 500, 650, 800, 1000, 2000, 5000, 10000, 20000, 50000, 100000),
+		TagKeys:     []tag.Key{keyCacher},
+	}
+
+	// OpenCensusViews are the views of the Cacher metrics, to be registered
+	// with Bindings.RegisterViews.
+	OpenCensusViews = []*view.View{
+		rebuildsView,
+		rebuildFailuresView,
+		rebuildDurationView,
+	}
+)
+
+// recordRebuild records a build of an object which started at start, and
+// failed if err is not nil.
+func recordRebuild(ctx context.Context, start time.Time, err error) {
+	ms := float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		stats.Record(ctx, mRebuildFailures.M(1), mRebuildDuration.M(ms))
+		return
+	}
+	stats.Record(ctx, mRebuilds.M(1), mRebuildDuration.M(ms))
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultEnvPrefix is the prefix of environment variables which override
+	// configuration values.
+	DefaultEnvPrefix = "OM"
+)
+
+// Options control where Read finds the configuration files and the layers it
+// merges on top of them.
+type Options struct {
+	// DefaultPaths are searched in order for the default file.
+	DefaultPaths []string
+	// DefaultName is the name of the default file, without extension.
+	DefaultName string
+	// OverridePaths are searched in order for the override file.
+	OverridePaths []string
+	// OverrideName is the name of the override file, without extension. The
+	// override file is optional.
+	OverrideName string
+	// OverrideFile is the path of the override file. If it is set, it is
+	// read instead of searching OverridePaths for OverrideName, and it must
+	// exist.
+	OverrideFile string
+	// FragmentsDir is a conf.d style directory. Its *.yaml and *.yml files
+	// are merged over the override file in lexical order. Empty disables
+	// fragments.
+	FragmentsDir string
+	// EnvPrefix is the prefix of environment variables overriding
+	// configuration values. An empty prefix disables the environment layer.
+	EnvPrefix string
+	// Sets are key=value pairs which override the configuration, usually
+	// given on the command line.
+	Sets keyValues
+	// Sources are merged after the fragments and before the environment
+	// variables, in order. Their changes reload the configuration.
+	Sources []Source
+	// SourceURLs are opened with NewSource and merged after Sources.
+	SourceURLs []string
+	// SourcePollInterval is how often the HTTP sources of SourceURLs are
+	// polled.
+	SourcePollInterval time.Duration
+	// Schema validates the merged configuration, if set. Read fails on an
+	// invalid configuration, and a reload to an invalid configuration is
+	// rejected.
+	Schema *Schema
+}
+
+// NewOptions returns the default Options.
+func NewOptions() *Options {
+	return &Options{
+		// The config paths need to be the same as the volumeMount paths defined via helm
+		DefaultPaths:       []string{".", "/app/config/default"},
+		DefaultName:        "matchmaker_config_default",
+		OverridePaths:      []string{".", "/app/config/override"},
+		OverrideName:       "matchmaker_config_override",
+		EnvPrefix:          DefaultEnvPrefix,
+		SourcePollInterval: DefaultSourcePollInterval,
+	}
+}
+
+// RegisterFlags binds the command-line flags of the configuration to fs. The
+// defaults of the file location flags are taken from environment variables
+// named after the flag, such as OM_CONFIG_DIR for -config.dir.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(o.envList("config.default.paths", &o.DefaultPaths), "config.default.paths", "comma-separated directories searched for the default config file")
+	fs.StringVar(&o.DefaultName, "config.default.name", o.env("config.default.name", o.DefaultName), "name of the default config file, without extension")
+	fs.Var(o.envList("config.override.paths", &o.OverridePaths), "config.override.paths", "comma-separated directories searched for the optional override config file")
+	fs.StringVar(&o.OverrideName, "config.override.name", o.env("config.override.name", o.OverrideName), "name of the override config file, without extension")
+	fs.StringVar(&o.FragmentsDir, "config.dir", o.env("config.dir", o.FragmentsDir), "directory of config fragments merged in lexical order after the override file")
+	fs.Var(o.envList("config.source", &o.SourceURLs), "config.source", "comma-separated URLs of config sources merged after the fragments, file:// or http(s)://")
+	fs.DurationVar(&o.SourcePollInterval, "config.source.interval", o.envDuration("config.source.interval", o.SourcePollInterval), "how often HTTP config sources are polled for changes")
+	fs.Var(&o.Sets, "set", "override a configuration value, as key=value. May be repeated.")
+}
+
+// env returns the environment variable of the flag name, or def.
+func (o *Options) env(name, def string) string {
+	if o.EnvPrefix == "" {
+		return def
+	}
+	key := strings.ToUpper(o.EnvPrefix + "_" + strings.Replace(name, ".", "_", -1))
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func (o *Options) envList(name string, l *[]string) *listValue {
+	v := (*listValue)(l)
+	if env := o.env(name, ""); env != "" {
+		_ = v.Set(env)
+	}
+	return v
+}
+
+func (o *Options) envDuration(name string, def time.Duration) time.Duration {
+	if env := o.env(name, ""); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// sources returns Sources followed by the sources of SourceURLs.
+func (o *Options) sources() ([]Source, error) {
+	sources := append([]Source(nil), o.Sources...)
+	for _, u := range o.SourceURLs {
+		src, err := NewSource(u, o.SourcePollInterval)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func (o *Options) flagSettings() (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	for _, kv := range o.Sets {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid configuration flag %q, expected key=value", kv)
+		}
+		settings[strings.ToLower(kv[:i])] = kv[i+1:]
+	}
+	return settings, nil
+}
+
+// keyValues is a repeatable flag.Value of key=value pairs.
+type keyValues []string
+
+func (kv *keyValues) String() string {
+	return strings.Join(*kv, ",")
+}
+
+func (kv *keyValues) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	*kv = append(*kv, s)
+	return nil
+}
+
+// listValue is a flag.Value of a comma-separated list.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
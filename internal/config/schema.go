@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// Type is the type of a configuration value.
+type Type int
+
+const (
+	// TypeString accepts any scalar value.
+	TypeString Type = iota
+	// TypeInt accepts integers.
+	TypeInt
+	// TypeFloat accepts numbers.
+	TypeFloat
+	// TypeBool accepts booleans.
+	TypeBool
+	// TypeDuration accepts durations such as "15s".
+	TypeDuration
+	// TypeStringSlice accepts lists of scalars.
+	TypeStringSlice
+	// TypeAny accepts any value, including any keys below the field.
+	TypeAny
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt:
+		return "int"
+	case TypeFloat:
+		return "float"
+	case TypeBool:
+		return "bool"
+	case TypeDuration:
+		return "duration"
+	case TypeStringSlice:
+		return "string slice"
+	case TypeAny:
+		return "any"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Range bounds a numeric value, inclusively.
+type Range struct {
+	Min, Max float64
+}
+
+// Field describes one configuration key.
+type Field struct {
+	// Key is the dotted key of the field. A "*" segment matches any one
+	// segment, so "api.*.httpport" matches the port of every service.
+	Key string
+	// Type of the value.
+	Type Type
+	// Required fields must be set. Required is ignored for keys with "*"
+	// segments.
+	Required bool
+	// Range bounds TypeInt and TypeFloat values, if set.
+	Range *Range
+	// Values lists the allowed values of a TypeString field, if not empty.
+	// They are compared case-insensitively.
+	Values []string
+}
+
+// Schema describes the known configuration keys.
+type Schema struct {
+	fields []Field
+	// owned are the sections whose unknown keys are rejected. If it is
+	// empty, every unknown key is rejected.
+	owned []string
+}
+
+// NewSchema returns a Schema of fields.
+func NewSchema(fields ...Field) *Schema {
+	s := &Schema{}
+	for _, f := range fields {
+		f.Key = strings.ToLower(f.Key)
+		s.fields = append(s.fields, f)
+	}
+	return s
+}
+
+// WithOwnedPrefixes restricts the check for unknown keys to the keys below
+// prefixes, such as "api". Keys of other sections belong to the applications,
+// and are only checked if a field matches them.
+func (s *Schema) WithOwnedPrefixes(prefixes ...string) *Schema {
+	for _, p := range prefixes {
+		s.owned = append(s.owned, strings.ToLower(p))
+	}
+	return s
+}
+
+// owns returns true if unknown keys such as k are rejected.
+func (s *Schema) owns(k string) bool {
+	if len(s.owned) == 0 {
+		return true
+	}
+	for _, p := range s.owned {
+		if matchKey(p, k, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidationError lists all problems found by Schema.Validate.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks nested settings, such as returned by AllSettings, against
+// the schema. It reports unknown keys, values of the wrong type or out of
+// range, and missing required keys. The returned error is a *ValidationError.
+func (s *Schema) Validate(settings map[string]interface{}) error {
+	return s.validate(settings, nil)
+}
+
+// validate is Validate, without revealing the values of the secret keys in
+// the problems.
+func (s *Schema) validate(settings map[string]interface{}, secrets map[string]bool) error {
+	var problems []string
+	flat := flatten("", settings)
+	for k, v := range flat {
+		f, ok := s.field(k)
+		if !ok {
+			if s.owns(k) {
+				problems = append(problems, fmt.Sprintf("unknown key %s", k))
+			}
+			continue
+		}
+		if err := f.check(v); err != nil {
+			if secrets[k] {
+				problems = append(problems, fmt.Sprintf("%s: invalid secret, expected %s", k, f.Type))
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s", k, err.Error()))
+		}
+	}
+
+	for _, f := range s.fields {
+		if !f.Required || strings.Contains(f.Key, "*") {
+			continue
+		}
+		if _, ok := flat[f.Key]; !ok {
+			problems = append(problems, fmt.Sprintf("missing required key %s", f.Key))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return &ValidationError{Problems: problems}
+}
+
+// field returns the field matching the leaf key k.
+func (s *Schema) field(k string) (Field, bool) {
+	for _, f := range s.fields {
+		if matchKey(f.Key, k, f.Type == TypeAny) {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// matchKey returns true if pattern matches key, where a "*" segment of pattern
+// matches any one segment. If prefix is true, pattern also matches the keys
+// below it.
+func matchKey(pattern, key string, prefix bool) bool {
+	ps := strings.Split(pattern, ".")
+	ks := strings.Split(key, ".")
+	if len(ks) < len(ps) || (!prefix && len(ks) != len(ps)) {
+		return false
+	}
+	for i := range ps {
+		if ps[i] != "*" && ps[i] != ks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Field) check(v interface{}) error {
+	var err error
+	var number float64
+	switch f.Type {
+	case TypeAny:
+		return nil
+	case TypeString:
+		var str string
+		if isMap(v) {
+			return fmt.Errorf("expected %s, got a map", f.Type)
+		}
+		str, err = cast.ToStringE(v)
+		if err == nil && len(f.Values) > 0 && !containsFold(f.Values, str) {
+			return fmt.Errorf("%q is not one of %s", str, strings.Join(f.Values, ", "))
+		}
+	case TypeInt:
+		var i int64
+		i, err = cast.ToInt64E(v)
+		number = float64(i)
+	case TypeFloat:
+		number, err = cast.ToFloat64E(v)
+	case TypeBool:
+		_, err = cast.ToBoolE(v)
+	case TypeDuration:
+		_, err = cast.ToDurationE(v)
+	case TypeStringSlice:
+		_, err = cast.ToStringSliceE(v)
+	}
+	if err != nil {
+		return fmt.Errorf("expected %s, got %v", f.Type, v)
+	}
+	if f.Range != nil && (f.Type == TypeInt || f.Type == TypeFloat) {
+		if number < f.Range.Min || number > f.Range.Max {
+			return fmt.Errorf("%v is not within [%v, %v]", v, f.Range.Min, f.Range.Max)
+		}
+	}
+	return nil
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchema_Validate(t *testing.T) {
+	s := NewSchema(
+		Field{Key: "telemetry.reportingPeriod", Type: TypeDuration, Required: true},
+		Field{Key: "telemetry.traceSamplingFraction", Type: TypeFloat, Range: &Range{Min: 0, Max: 1}},
+		Field{Key: "logging.level", Type: TypeString, Values: []string{"debug", "info"}},
+		Field{Key: "api.*.httpport", Type: TypeInt, Range: &Range{Min: 0, Max: 65535}},
+		Field{Key: "extensions", Type: TypeAny},
+	)
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		problems []string
+	}{
+		{
+			name: "valid",
+			settings: map[string]interface{}{
+				"telemetry":  map[string]interface{}{"reportingPeriod": "15s", "traceSamplingFraction": 0.5},
+				"logging":    map[string]interface{}{"level": "INFO"},
+				"api":        map[string]interface{}{"test": map[string]interface{}{"httpport": "8081"}},
+				"extensions": map[string]interface{}{"anything": map[string]interface{}{"goes": true}},
+			},
+		},
+		{
+			name: "shipped mistakes",
+			settings: map[string]interface{}{
+				"telemetry": map[string]interface{}{"reportingPeriod": "15s", "traceSamplingFraction": 2},
+				"log":       map[string]interface{}{"level": "info"},
+			},
+			problems: []string{
+				"telemetry.tracesamplingfraction: 2 is not within [0, 1]",
+				"unknown key log.level",
+			},
+		},
+		{
+			name: "types and required",
+			settings: map[string]interface{}{
+				"logging": map[string]interface{}{"level": "verbose"},
+				"api":     map[string]interface{}{"test": map[string]interface{}{"httpport": "http"}},
+			},
+			problems: []string{
+				"api.test.httpport: expected int, got http",
+				"logging.level: \"verbose\" is not one of debug, info",
+				"missing required key telemetry.reportingperiod",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Validate(tt.settings)
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			if !reflect.DeepEqual(verr.Problems, tt.problems) {
+				t.Fatalf("expected %q, got %q", tt.problems, verr.Problems)
+			}
+		})
+	}
+}
+
+func TestSchema_OwnedPrefixes(t *testing.T) {
+	s := NewSchema(
+		Field{Key: "api.*.httpport", Type: TypeInt},
+		Field{Key: "matchmaker.pool.rate", Type: TypeFloat},
+	).WithOwnedPrefixes("api", "matchmaker")
+
+	err := s.Validate(map[string]interface{}{
+		"api":        map[string]interface{}{"test": map[string]interface{}{"httpport": 8081, "hostport": 1}},
+		"matchmaker": map[string]interface{}{"pool": map[string]interface{}{"rate": "fast"}},
+		"game":       map[string]interface{}{"maxPlayers": 10},
+	})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+	expected := []string{
+		"matchmaker.pool.rate: expected float, got fast",
+		"unknown key api.test.hostport",
+	}
+	if !reflect.DeepEqual(verr.Problems, expected) {
+		t.Fatalf("expected %q, got %q", expected, verr.Problems)
+	}
+}
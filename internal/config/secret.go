@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// secretFilePrefix starts a value which is replaced by the content of a
+	// file, such as "secret://file/var/run/secrets/tls.key".
+	secretFilePrefix = "secret://file"
+)
+
+// envReference matches ${env:NAME} anywhere in a value.
+var envReference = regexp.MustCompile(`\$\{env:([^}]*)\}`)
+
+// isSecretReference returns true if v references a secret.
+func isSecretReference(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && (strings.HasPrefix(s, secretFilePrefix) || envReference.MatchString(s))
+}
+
+// resolveSecrets replaces the secret references in the leaf values of flat.
+// It returns the resolved settings, which keys held references, and the files
+// which were read.
+func resolveSecrets(flat map[string]interface{}) (resolved map[string]interface{}, secrets map[string]bool, files []string, err error) {
+	resolved = make(map[string]interface{}, len(flat))
+	secrets = map[string]bool{}
+	for k, v := range flat {
+		resolved[k] = v
+		if !isSecretReference(v) {
+			continue
+		}
+		s := v.(string)
+		secrets[k] = true
+		if strings.HasPrefix(s, secretFilePrefix) {
+			path := strings.TrimPrefix(s, secretFilePrefix)
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("cannot read secret file of %s: %s", k, err.Error())
+			}
+			files = append(files, path)
+			resolved[k] = strings.TrimRight(string(b), "\r\n")
+			continue
+		}
+
+		var missing []string
+		resolved[k] = envReference.ReplaceAllStringFunc(s, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return nil, nil, nil, fmt.Errorf("environment variables %s referenced by %s are not set", strings.Join(missing, ", "), k)
+		}
+	}
+	return resolved, secrets, files, nil
+}
+
+// IsSecret returns true if the value of the leaf key k is resolved from a
+// secret reference. Such values must not be logged or dumped.
+func (s *Store) IsSecret(k string) bool {
+	return s.snapshot().secrets[strings.ToLower(k)]
+}
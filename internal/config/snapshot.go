@@ -0,0 +1,42 @@
+package config
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// snapshot is one immutable version of the configuration. It must not be
+// modified once it is served by a Store.
+type snapshot struct {
+	// Viper holds the values with secret references resolved.
+	*viper.Viper
+	// raw holds the values as set by the layers, with secret references
+	// unresolved.
+	raw *viper.Viper
+	// secrets are the leaf keys whose values were resolved from secret
+	// references.
+	secrets map[string]bool
+	// files are the files the snapshot was read from.
+	files []string
+	// dirs are fragment directories, in which new files also change the
+	// configuration.
+	dirs []string
+	// origins are the layers which set each leaf key.
+	origins map[string]Layer
+	// version and changed are set when the snapshot is applied by a Store.
+	version Version
+	// changed is when the value of each leaf key last changed.
+	changed map[string]time.Time
+}
+
+// AllSettings returns the settings with secret references unresolved, so they
+// are safe to dump.
+func (s *snapshot) AllSettings() map[string]interface{} {
+	return s.raw.AllSettings()
+}
+
+// resolvedSettings returns the settings with secret references resolved.
+func (s *snapshot) resolvedSettings() map[string]interface{} {
+	return s.Viper.AllSettings()
+}
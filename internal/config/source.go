@@ -0,0 +1,190 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"siody.home/om-like/internal/filewatch"
+)
+
+const (
+	// DefaultSourcePollInterval is how often HTTP sources are polled for
+	// changes when no interval is configured.
+	DefaultSourcePollInterval = 30 * time.Second
+
+	sourceRequestTimeout = 10 * time.Second
+)
+
+// Source is a layer of configuration kept outside of the config files, such as
+// in a key/value service. Sources are merged after the fragments and before
+// the environment variables, in the order they are given, and their settings
+// are reported with the layer "source:<name>".
+type Source interface {
+	// Name identifies the source in logs and layers.
+	Name() string
+	// Load returns the current settings of the source.
+	Load() (map[string]interface{}, error)
+	// Watch calls changed whenever the settings of the source may have
+	// changed, until stop is closed. It returns once watching has started.
+	Watch(stop <-chan struct{}, changed func()) error
+}
+
+// NewSource returns the Source of rawurl. file:// URLs are read from the
+// local file system and watched for changes, http:// and https:// URLs are
+// fetched and polled every interval. The settings are YAML or JSON.
+func NewSource(rawurl string, interval time.Duration) (Source, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config source %q, desc: %s", rawurl, err.Error())
+	}
+	switch u.Scheme {
+	case "file":
+		return NewFileSource(u.Path), nil
+	case "http", "https":
+		return NewHTTPSource(rawurl, interval), nil
+	}
+	return nil, fmt.Errorf("invalid config source %q, unsupported scheme %q", rawurl, u.Scheme)
+}
+
+// sourceLayer returns the layer of a config source, "source:<name>". Sources
+// are merged after the fragments.
+func sourceLayer(src Source) Layer {
+	return Layer("source:" + src.Name())
+}
+
+func parseSettings(content []byte) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return nil, err
+	}
+	return v.AllSettings(), nil
+}
+
+// FileSource is a Source read from a YAML file.
+type FileSource struct {
+	path string
+}
+
+// NewFileSource returns the Source of the YAML file at path.
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: filepath.Clean(path)}
+}
+
+// Name implements Source.
+func (f *FileSource) Name() string { return "file://" + f.path }
+
+// Load implements Source.
+func (f *FileSource) Load() (map[string]interface{}, error) {
+	return readFile(f.path)
+}
+
+// Watch implements Source. The directory of the file is watched, so that
+// replacing the file or the symlink to it is noticed.
+func (f *FileSource) Watch(stop <-chan struct{}, changed func()) error {
+	w, err := filewatch.New(0, changed, func(err error) {
+		logger.WithError(err).WithField("source", f.Name()).Warning("error watching config source")
+	})
+	if err != nil {
+		return err
+	}
+	if err = w.Watch([]string{f.path}, nil, nil); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		<-stop
+		w.Close()
+	}()
+	return nil
+}
+
+// HTTPSource is a Source fetched from a URL with GET requests. The response
+// body is YAML or JSON. Changes are found by polling.
+type HTTPSource struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	m    sync.Mutex
+	hash [sha256.Size]byte
+}
+
+// NewHTTPSource returns the Source of url, polled every interval. A
+// non-positive interval uses DefaultSourcePollInterval.
+func NewHTTPSource(url string, interval time.Duration) *HTTPSource {
+	if interval <= 0 {
+		interval = DefaultSourcePollInterval
+	}
+	return &HTTPSource{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: sourceRequestTimeout},
+	}
+}
+
+// Name implements Source.
+func (h *HTTPSource) Name() string { return h.url }
+
+// Load implements Source.
+func (h *HTTPSource) Load() (map[string]interface{}, error) {
+	body, err := h.fetch()
+	if err != nil {
+		return nil, err
+	}
+	h.m.Lock()
+	h.hash = sha256.Sum256(body)
+	h.m.Unlock()
+	return parseSettings(body)
+}
+
+// Watch implements Source. The URL is fetched every interval, and changed is
+// called when the response body differs from the one last seen.
+func (h *HTTPSource) Watch(stop <-chan struct{}, changed func()) error {
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			body, err := h.fetch()
+			if err != nil {
+				logger.WithError(err).WithField("source", h.url).Warning("cannot poll config source")
+				continue
+			}
+			hash := sha256.Sum256(body)
+			h.m.Lock()
+			differs := hash != h.hash
+			h.hash = hash
+			h.m.Unlock()
+			if differs {
+				logger.WithField("source", h.url).Debug("config source changed")
+				changed()
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *HTTPSource) fetch() ([]byte, error) {
+	resp, err := h.client.Get(h.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("config source %s returned %s", h.url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
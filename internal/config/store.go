@@ -0,0 +1,211 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"siody.home/om-like/internal/filewatch"
+)
+
+var (
+	logger = logrus.WithFields(logrus.Fields{
+		"app":       "openmatch",
+		"component": "config",
+	})
+)
+
+// Store is the live configuration returned by Read. Reads are served from an
+// immutable snapshot, which is replaced as a whole when the configuration
+// files change, so readers never observe a partially applied reload.
+type Store struct {
+	load func() (*snapshot, error)
+
+	m             sync.RWMutex
+	current       *snapshot
+	history       []*snapshot
+	lastRejection *Rejection
+	subs          map[int]*subscription
+	nextSub       int
+
+	reloadLock sync.Mutex
+	watcher    *filewatch.Watcher
+	// stop is closed by Close to stop watching the sources.
+	stop chan struct{}
+}
+
+// newStore loads the first snapshot. load must return a new snapshot each time
+// it is called.
+func newStore(load func() (*snapshot, error)) (*Store, error) {
+	current, err := load()
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		load:    load,
+		current: current,
+		subs:    make(map[int]*subscription),
+		stop:    make(chan struct{}),
+	}
+	s.pushHistory(nil, current, "startup")
+	return s, nil
+}
+
+func (s *Store) snapshot() *snapshot {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.current
+}
+
+// IsSet implements View.
+func (s *Store) IsSet(k string) bool { return s.snapshot().IsSet(k) }
+
+// GetString implements View.
+func (s *Store) GetString(k string) string { return s.snapshot().GetString(k) }
+
+// GetInt implements View.
+func (s *Store) GetInt(k string) int { return s.snapshot().GetInt(k) }
+
+// GetInt64 implements View.
+func (s *Store) GetInt64(k string) int64 { return s.snapshot().GetInt64(k) }
+
+// GetFloat64 implements View.
+func (s *Store) GetFloat64(k string) float64 { return s.snapshot().GetFloat64(k) }
+
+// GetStringSlice implements View.
+func (s *Store) GetStringSlice(k string) []string { return s.snapshot().GetStringSlice(k) }
+
+// GetBool implements View.
+func (s *Store) GetBool(k string) bool { return s.snapshot().GetBool(k) }
+
+// GetDuration implements View.
+func (s *Store) GetDuration(k string) time.Duration { return s.snapshot().GetDuration(k) }
+
+// GetStringMap implements View.
+func (s *Store) GetStringMap(k string) map[string]interface{} { return s.snapshot().GetStringMap(k) }
+
+// GetStringMapString implements View.
+func (s *Store) GetStringMapString(k string) map[string]string {
+	return s.snapshot().GetStringMapString(k)
+}
+
+// GetIntSlice implements View.
+func (s *Store) GetIntSlice(k string) []int { return s.snapshot().GetIntSlice(k) }
+
+// GetTime implements View.
+func (s *Store) GetTime(k string) time.Time { return s.snapshot().GetTime(k) }
+
+// GetSizeInBytes implements View.
+func (s *Store) GetSizeInBytes(k string) uint { return s.snapshot().GetSizeInBytes(k) }
+
+// AllSettings returns the merged settings of the current snapshot, with
+// secret references unresolved.
+func (s *Store) AllSettings() map[string]interface{} { return s.snapshot().AllSettings() }
+
+// Origin returns the layer which set the effective value of the leaf key k,
+// or an empty Layer if k is not set.
+func (s *Store) Origin(k string) Layer {
+	return s.snapshot().origins[strings.ToLower(k)]
+}
+
+// watch reloads the Store whenever the files or the fragments of the current
+// snapshot change. Directories are watched instead of the files, because
+// Kubernetes replaces ConfigMap files by swapping a symlink.
+func (s *Store) watch() error {
+	w, err := filewatch.New(filewatch.DefaultDebounce, s.reload, func(err error) {
+		logger.WithError(err).Warning("error watching configuration files")
+	})
+	if err != nil {
+		return err
+	}
+	snap := s.snapshot()
+	if err := w.Watch(snap.files, snap.dirs, isFragment); err != nil {
+		w.Close()
+		return err
+	}
+	s.m.Lock()
+	s.watcher = w
+	s.m.Unlock()
+	return nil
+}
+
+// scheduleReload reloads the Store once the configuration files and sources
+// stopped changing for filewatch.DefaultDebounce.
+func (s *Store) scheduleReload() {
+	s.m.RLock()
+	w := s.watcher
+	s.m.RUnlock()
+	if w != nil {
+		w.Trigger()
+	}
+}
+
+// reload builds a new snapshot and applies it if it differs from the current
+// one. If loading or validating fails, the reload is rejected and the current
+// snapshot stays active.
+func (s *Store) reload() {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	next, err := s.load()
+	if err != nil {
+		s.reject(err)
+		return
+	}
+
+	s.m.RLock()
+	w := s.watcher
+	s.m.RUnlock()
+	if w != nil {
+		if err := w.Watch(next.files, next.dirs, isFragment); err != nil {
+			logger.WithError(err).Warning("cannot watch configuration files")
+		}
+	}
+
+	if reflect.DeepEqual(s.snapshot().resolvedSettings(), next.resolvedSettings()) {
+		logger.Debug("configuration files changed without changing the configuration")
+		return
+	}
+	s.apply(next, "reload")
+}
+
+// apply replaces the current snapshot and notifies the subscribers whose keys
+// changed. s.reloadLock must be held.
+func (s *Store) apply(next *snapshot, cause string) {
+	s.m.Lock()
+	prev := s.current
+	s.current = next
+	s.pushHistory(prev, next, cause)
+	subs := make([]*subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.m.Unlock()
+
+	logger.WithFields(logrus.Fields{
+		"version": next.version.Number,
+		"hash":    next.version.Hash,
+		"cause":   cause,
+	}).Info("Server configuration changed")
+	for _, sub := range subs {
+		sub.notify(prev, next)
+	}
+}
+
+// Close stops watching the configuration files and sources.
+func (s *Store) Close() error {
+	s.m.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	w := s.watcher
+	s.m.Unlock()
+	if w != nil {
+		return w.Close()
+	}
+	return nil
+}
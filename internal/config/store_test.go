@@ -0,0 +1,357 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func newTestStore(t *testing.T, settings ...map[string]interface{}) *Store {
+	i := 0
+	s, err := newStore(func() (*snapshot, error) {
+		if i >= len(settings) {
+			return nil, errors.New("no more settings")
+		}
+		v := viper.New()
+		if err := v.MergeConfigMap(settings[i]); err != nil {
+			return nil, err
+		}
+		i++
+		return &snapshot{Viper: v, raw: v}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore_Watch(t *testing.T) {
+	s := newTestStore(t,
+		map[string]interface{}{"logging": map[string]interface{}{"level": "info"}, "api": map[string]interface{}{"port": 1}},
+		map[string]interface{}{"logging": map[string]interface{}{"level": "info"}, "api": map[string]interface{}{"port": 2}},
+		map[string]interface{}{"logging": map[string]interface{}{"level": "debug"}, "api": map[string]interface{}{"port": 2}},
+	)
+
+	var logging, api, all int
+	Watch(s, "logging", func(old, new View) {
+		logging++
+		if old.GetString("logging.level") != "info" || new.GetString("logging.level") != "debug" {
+			t.Errorf("unexpected change %s -> %s", old.GetString("logging.level"), new.GetString("logging.level"))
+		}
+	})
+	cancel := Watch(s, "api.port", func(_, _ View) { api++ })
+	Watch(s, "", func(_, _ View) { all++ })
+
+	s.reload()
+	if s.GetInt("api.port") != 2 || logging != 0 || api != 1 || all != 1 {
+		t.Fatalf("unexpected state after first reload: port=%d logging=%d api=%d all=%d", s.GetInt("api.port"), logging, api, all)
+	}
+
+	cancel()
+	s.reload()
+	if s.GetString("logging.level") != "debug" || logging != 1 || api != 1 || all != 2 {
+		t.Fatalf("unexpected state after second reload: logging=%d api=%d all=%d", logging, api, all)
+	}
+
+	// A failed reload keeps the current configuration.
+	s.reload()
+	if s.GetString("logging.level") != "debug" || all != 2 {
+		t.Fatal("failed reload changed the configuration")
+	}
+}
+
+func TestLayering(t *testing.T) {
+	l := newLayering()
+	if err := l.merge(LayerDefault, map[string]interface{}{
+		"api": map[string]interface{}{"test": map[string]interface{}{"httpport": 8081, "hostname": "a"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.merge(LayerOverride, map[string]interface{}{
+		"api": map[string]interface{}{"test": map[string]interface{}{"hostname": "b"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("OMTEST_API_TEST_HTTPPORT", "9000")
+	defer os.Unsetenv("OMTEST_API_TEST_HTTPPORT")
+	if err := l.mergeFlat(LayerEnv, envSettings("OMTEST", l.keys())); err != nil {
+		t.Fatal(err)
+	}
+
+	o := NewOptions()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-set", "api.test.hostname=c", "-set", "logging.level=debug"}); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := o.flagSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.mergeFlat(LayerFlag, flags); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := l.viper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]struct {
+		value string
+		layer Layer
+	}{
+		"api.test.httpport": {"9000", LayerEnv},
+		"api.test.hostname": {"c", LayerFlag},
+		"logging.level":     {"debug", LayerFlag},
+	} {
+		if got := v.GetString(k); got != want.value {
+			t.Errorf("%s: expected %q, got %q", k, want.value, got)
+		}
+		if got := l.origins[k]; got != want.layer {
+			t.Errorf("%s: expected layer %s, got %s", k, want.layer, got)
+		}
+	}
+	if got := v.GetInt("api.test.httpport"); got != 9000 {
+		t.Errorf("expected port 9000, got %d", got)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad_FilesAndFragments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fragments := filepath.Join(dir, "conf.d")
+	if err = os.Mkdir(fragments, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "base.yaml"), "a: default\nb: default\nc: default\nd: default\n")
+	writeFile(t, filepath.Join(fragments, "20-second.yaml"), "c: second\n")
+	writeFile(t, filepath.Join(fragments, "10-first.yml"), "b: first\nc: first\n")
+	writeFile(t, filepath.Join(fragments, ".hidden.yaml"), "d: hidden\n")
+	writeFile(t, filepath.Join(fragments, "notes.txt"), "d: text\n")
+
+	o := NewOptions()
+	o.EnvPrefix = ""
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o.RegisterFlags(fs)
+	err = fs.Parse([]string{
+		"-config.default.paths", dir,
+		"-config.default.name", "base",
+		"-config.override.paths", dir,
+		"-config.dir", fragments,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := load(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]struct {
+		value string
+		layer Layer
+	}{
+		"a": {"default", LayerDefault},
+		"b": {"first", "fragment:10-first.yml"},
+		"c": {"second", "fragment:20-second.yaml"},
+		"d": {"default", LayerDefault},
+	} {
+		if got := snap.GetString(k); got != want.value {
+			t.Errorf("%s: expected %q, got %q", k, want.value, got)
+		}
+		if got := snap.origins[k]; got != want.layer {
+			t.Errorf("%s: expected layer %s, got %s", k, want.layer, got)
+		}
+	}
+}
+
+func TestStore_HistoryAndRollback(t *testing.T) {
+	s := newTestStore(t,
+		map[string]interface{}{"a": 1},
+		map[string]interface{}{"a": 2},
+	)
+	var changes []int
+	Watch(s, "a", func(_, new View) { changes = append(changes, new.GetInt("a")) })
+
+	s.reload()
+	s.reload() // Fails, no more settings.
+
+	h := s.History()
+	if len(h.Versions) != 2 || h.Versions[0].Cause != "startup" || h.Versions[1].Cause != "reload" {
+		t.Fatalf("unexpected history %+v", h.Versions)
+	}
+	if h.Versions[0].Hash == h.Versions[1].Hash {
+		t.Fatal("expected different hashes for different settings")
+	}
+	if h.LastRejection == nil || h.LastRejection.Error != "no more settings" {
+		t.Fatalf("unexpected rejection %+v", h.LastRejection)
+	}
+
+	if err := s.Rollback(7); err == nil {
+		t.Fatal("expected an error rolling back to an unknown version")
+	}
+	if err := s.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	h = s.History()
+	last := h.Versions[len(h.Versions)-1]
+	if s.GetInt("a") != 1 || last.Number != 3 || last.Hash != h.Versions[0].Hash || last.Cause != "rollback to 1" {
+		t.Fatalf("unexpected state after rollback: a=%d version=%+v", s.GetInt("a"), last)
+	}
+	if !reflect.DeepEqual(changes, []int{2, 1}) {
+		t.Fatalf("unexpected notifications %v", changes)
+	}
+}
+
+func TestLoad_Secrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "password")
+	writeFile(t, secretFile, "hunter2\n")
+	writeFile(t, filepath.Join(dir, "base.yaml"), "db:\n  password: secret://file"+secretFile+"\n  dsn: user:${env:OMTEST_DB_PASS}@host\n  name: plain\n")
+	os.Setenv("OMTEST_DB_PASS", "pass")
+	defer os.Unsetenv("OMTEST_DB_PASS")
+
+	o := NewOptions()
+	o.DefaultPaths = []string{dir}
+	o.DefaultName = "base"
+	o.OverridePaths = []string{dir}
+	o.Schema = NewSchema(Field{Key: "db.*", Type: TypeString, Values: []string{"plain"}})
+
+	_, err = load(o, nil)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 2 || verr.Problems[0] != "db.dsn: invalid secret, expected string" {
+		t.Fatalf("expected redacted validation problems, got %v", err)
+	}
+
+	o.Schema = nil
+	snap, err := load(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snap.GetString("db.password"); got != "hunter2" {
+		t.Errorf("expected resolved password, got %q", got)
+	}
+	if got := snap.GetString("db.dsn"); got != "user:pass@host" {
+		t.Errorf("expected resolved dsn, got %q", got)
+	}
+	raw := flatten("", snap.AllSettings())
+	if raw["db.password"] != "secret://file"+secretFile || raw["db.dsn"] != "user:${env:OMTEST_DB_PASS}@host" {
+		t.Errorf("expected unresolved references in settings, got %v", raw)
+	}
+	if !snap.secrets["db.password"] || !snap.secrets["db.dsn"] || snap.secrets["db.name"] {
+		t.Errorf("unexpected secret keys %v", snap.secrets)
+	}
+	found := false
+	for _, f := range snap.files {
+		found = found || f == secretFile
+	}
+	if !found {
+		t.Errorf("expected the secret file to be watched, got %v", snap.files)
+	}
+
+	os.Unsetenv("OMTEST_DB_PASS")
+	if _, err = load(o, nil); err == nil {
+		t.Error("expected an error for a missing environment variable")
+	}
+}
+
+func TestStore_Settings(t *testing.T) {
+	s := newTestStore(t,
+		map[string]interface{}{"a": 1, "b": 1},
+		map[string]interface{}{"a": 1, "b": 2},
+	)
+	s.m.Lock()
+	s.current.secrets = map[string]bool{"a": true}
+	s.m.Unlock()
+	started := s.Settings()
+
+	time.Sleep(time.Millisecond)
+	s.reload()
+	reloaded := s.Settings()
+
+	if started[0].Key != "a" || started[0].Value != Redacted || !started[0].Secret {
+		t.Errorf("expected a to be redacted, got %+v", started[0])
+	}
+	if !reloaded[0].Changed.Equal(started[0].Changed) {
+		t.Errorf("expected unchanged a to keep its change time, got %v and %v", started[0].Changed, reloaded[0].Changed)
+	}
+	if !reloaded[1].Changed.After(started[1].Changed) || reloaded[1].Value != 2 {
+		t.Errorf("expected b to change, got %+v and %+v", started[1], reloaded[1])
+	}
+}
+
+func TestReadOptions_HTTPSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "base.yaml"), "api:\n  port: 1\n  name: default\n")
+
+	var m sync.Mutex
+	body := "api:\n  port: 2\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	o := NewOptions()
+	o.EnvPrefix = ""
+	o.DefaultPaths = []string{dir}
+	o.DefaultName = "base"
+	o.OverridePaths = []string{dir}
+	o.SourceURLs = []string{srv.URL}
+	o.SourcePollInterval = 10 * time.Millisecond
+	s, err := ReadOptions(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.GetInt("api.port") != 2 || s.GetString("api.name") != "default" {
+		t.Fatalf("unexpected settings %v", s.AllSettings())
+	}
+	if got, want := s.Origin("api.port"), Layer("source:"+srv.URL); got != want {
+		t.Errorf("expected layer %s, got %s", want, got)
+	}
+
+	changed := make(chan int, 1)
+	Watch(s, "api.port", func(_, new View) { changed <- new.GetInt("api.port") })
+	m.Lock()
+	body = "api:\n  port: 3\n"
+	m.Unlock()
+	select {
+	case port := <-changed:
+		if port != 3 {
+			t.Errorf("expected port 3, got %d", port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("source change was not applied")
+	}
+}
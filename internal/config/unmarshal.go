@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cast"
+)
+
+// Unmarshal decodes the keys below key into out, which must be a pointer to a
+// struct or map. Fields are matched to keys case-insensitively, or by their
+// `mapstructure` tag, and strings are converted to durations, slices and
+// numbers like the View accessors do. The keys are read with GetStringMap, so
+// a Cacher detects when any of them changes.
+func Unmarshal(v View, key string, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           out,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(v.GetStringMap(key))
+}
+
+// parseSizeInBytes parses sizes such as "512", "10kb" or "1GB", like viper.
+func parseSizeInBytes(sizeStr string) uint {
+	sizeStr = strings.TrimSpace(sizeStr)
+	multiplier := uint(1)
+	if n := len(sizeStr); n > 2 && unicode.ToLower(rune(sizeStr[n-1])) == 'b' {
+		switch unicode.ToLower(rune(sizeStr[n-2])) {
+		case 'k':
+			multiplier = 1 << 10
+			sizeStr = sizeStr[:n-2]
+		case 'm':
+			multiplier = 1 << 20
+			sizeStr = sizeStr[:n-2]
+		case 'g':
+			multiplier = 1 << 30
+			sizeStr = sizeStr[:n-2]
+		default:
+			sizeStr = sizeStr[:n-1]
+		}
+	}
+	size := cast.ToInt(strings.TrimSpace(sizeStr))
+	if size < 0 {
+		size = 0
+	}
+	return uint(size) * multiplier
+}
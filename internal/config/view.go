@@ -1,9 +1,8 @@
 package config
 
 import (
+	"strings"
 	"time"
-
-	"github.com/spf13/viper"
 )
 
 // View is a read-only view of the Open Match configuration.
@@ -17,6 +16,12 @@ type View interface {
 	GetStringSlice(string) []string
 	GetBool(string) bool
 	GetDuration(string) time.Duration
+	GetStringMap(string) map[string]interface{}
+	GetStringMapString(string) map[string]string
+	GetIntSlice(string) []int
+	GetTime(string) time.Time
+	// GetSizeInBytes parses sizes such as "512", "10kb" or "1GB".
+	GetSizeInBytes(string) uint
 }
 
 // Mutable is a read-write view of the Open Match configuration.
@@ -25,11 +30,47 @@ type Mutable interface {
 	View
 }
 
-// Sub returns a subset of configuration filtered by the key.
+// Sub returns a subset of configuration filtered by the key, or nil if key is
+// not set. The subset reads through v, so it follows changes of v, and reads of
+// a subset of the View passed to a NewInstanceFunc are tracked by the Cacher.
+// If v is Watchable, so is the subset.
 func Sub(v View, key string) View {
-	vcfg, ok := v.(*viper.Viper)
-	if ok {
-		return vcfg.Sub(key)
+	if !v.IsSet(key) {
+		return nil
+	}
+	return &subView{
+		parent: v,
+		prefix: strings.ToLower(key) + ".",
 	}
-	return nil
+}
+
+// subView is the View of the keys below prefix in parent.
+type subView struct {
+	parent View
+	prefix string
+}
+
+func (s *subView) IsSet(k string) bool                { return s.parent.IsSet(s.prefix + k) }
+func (s *subView) GetString(k string) string          { return s.parent.GetString(s.prefix + k) }
+func (s *subView) GetInt(k string) int                { return s.parent.GetInt(s.prefix + k) }
+func (s *subView) GetInt64(k string) int64            { return s.parent.GetInt64(s.prefix + k) }
+func (s *subView) GetFloat64(k string) float64        { return s.parent.GetFloat64(s.prefix + k) }
+func (s *subView) GetStringSlice(k string) []string   { return s.parent.GetStringSlice(s.prefix + k) }
+func (s *subView) GetBool(k string) bool              { return s.parent.GetBool(s.prefix + k) }
+func (s *subView) GetDuration(k string) time.Duration { return s.parent.GetDuration(s.prefix + k) }
+func (s *subView) GetStringMap(k string) map[string]interface{} {
+	return s.parent.GetStringMap(s.prefix + k)
+}
+func (s *subView) GetStringMapString(k string) map[string]string {
+	return s.parent.GetStringMapString(s.prefix + k)
+}
+func (s *subView) GetIntSlice(k string) []int   { return s.parent.GetIntSlice(s.prefix + k) }
+func (s *subView) GetTime(k string) time.Time   { return s.parent.GetTime(s.prefix + k) }
+func (s *subView) GetSizeInBytes(k string) uint { return s.parent.GetSizeInBytes(s.prefix + k) }
+
+// Watch implements Watchable, if the parent View is Watchable.
+func (s *subView) Watch(key string, fn ChangeFunc) (cancel func()) {
+	return Watch(s.parent, strings.TrimSuffix(s.prefix+key, "."), func(old, new View) {
+		fn(&subView{parent: old, prefix: s.prefix}, &subView{parent: new, prefix: s.prefix})
+	})
 }
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	m.Set("api.test", map[string]interface{}{"httpPort": "8081", "hostname": "a"})
+	m.Set("logging.level", "debug")
+
+	if got := m.GetInt("api.test.httpport"); got != 8081 {
+		t.Errorf("expected 8081, got %d", got)
+	}
+	if !m.IsSet("api") || !m.IsSet("API.Test.Hostname") || m.IsSet("api.test.grpcport") {
+		t.Error("unexpected IsSet results")
+	}
+
+	var changes int
+	cancel := Watch(m, "api.test", func(old, new View) {
+		changes++
+		if old.GetString("api.test.hostname") != "a" || new.GetString("api.test.hostname") != "b" {
+			t.Errorf("unexpected change %q -> %q", old.GetString("api.test.hostname"), new.GetString("api.test.hostname"))
+		}
+	})
+	m.Set("logging.level", "info")
+	m.Set("api.test.hostname", "b")
+	cancel()
+	m.Set("api.test.hostname", "c")
+	if changes != 1 {
+		t.Errorf("expected 1 change, got %d", changes)
+	}
+
+	// Setting a key replaces the keys below it.
+	m.Set("api", "none")
+	if m.IsSet("api.test.httpport") || m.GetString("api") != "none" {
+		t.Error("expected api to replace its subtree")
+	}
+}
+
+func TestSub(t *testing.T) {
+	m := NewMemory()
+	m.Set("db.host", "a")
+	m.Set("db.port", 1)
+
+	if Sub(m, "cache") != nil {
+		t.Error("expected nil Sub of an unset key")
+	}
+
+	c := NewCacher(m, func(cfg View) (interface{}, func(), error) {
+		db := Sub(cfg, "db")
+		return db.GetString("host"), nil, nil
+	})
+	get := func() string {
+		v, err := c.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.(string)
+	}
+
+	if got := get(); got != "a" {
+		t.Fatalf("expected a, got %s", got)
+	}
+	m.Set("db.port", 2)
+	m.Set("db.host", "b")
+	if got := get(); got != "b" {
+		t.Fatalf("expected the Cacher to track reads through Sub, got %s", got)
+	}
+
+	var changed string
+	Watch(Sub(m, "db"), "host", func(_, new View) { changed = new.GetString("host") })
+	m.Set("db.host", "c")
+	if changed != "c" {
+		t.Fatalf("expected Watch through Sub, got %q", changed)
+	}
+}
+
+func TestUnmarshalAndCacher(t *testing.T) {
+	type pool struct {
+		Size     int
+		Timeout  time.Duration
+		Hosts    []string
+		MaxBytes uint `mapstructure:"max_bytes"`
+	}
+
+	m := NewMemory()
+	m.Set("pool", map[string]interface{}{
+		"size":      "4",
+		"timeout":   "2s",
+		"hosts":     "a,b",
+		"max_bytes": 10,
+		"labels":    map[string]interface{}{"team": "core"},
+	})
+	m.Set("limits.ports", []int{80, 443})
+	m.Set("limits.buffer", "2kb")
+	m.Set("limits.since", "2020-01-02T03:04:05Z")
+
+	var builds int
+	c := NewCacher(m, func(cfg View) (interface{}, func(), error) {
+		builds++
+		p := &pool{}
+		if err := Unmarshal(cfg, "pool", p); err != nil {
+			return nil, nil, err
+		}
+		cfg.GetIntSlice("limits.ports")
+		cfg.GetSizeInBytes("limits.buffer")
+		cfg.GetTime("limits.since")
+		cfg.GetStringMapString("pool.labels")
+		return p, nil, nil
+	})
+
+	v, err := c.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pool{Size: 4, Timeout: 2 * time.Second, Hosts: []string{"a", "b"}, MaxBytes: 10}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("expected %+v, got %+v", want, v)
+	}
+	if m.GetSizeInBytes("limits.buffer") != 2048 || m.GetStringMapString("pool.labels")["team"] != "core" {
+		t.Fatal("unexpected accessor results")
+	}
+
+	for _, change := range []struct {
+		key   string
+		value interface{}
+	}{
+		{"pool.labels.team", "edge"},
+		{"limits.ports", []int{80}},
+		{"limits.buffer", "3kb"},
+		{"limits.since", "2021-01-02T03:04:05Z"},
+		{"pool.size", 5},
+	} {
+		before := builds
+		m.Set(change.key, change.value)
+		if _, err = c.Get(); err != nil {
+			t.Fatal(err)
+		}
+		if builds != before+1 {
+			t.Errorf("expected a change of %s to rebuild", change.key)
+		}
+	}
+}
+
+func TestCacher_BackgroundRebuild(t *testing.T) {
+	m := NewMemory()
+	m.Set("port", 1)
+
+	closed := make(chan int, 2)
+	block := make(chan struct{})
+	c := NewCacher(m, func(cfg View) (interface{}, func(), error) {
+		port := cfg.GetInt("port")
+		if port == 2 {
+			<-block
+		}
+		if port == 3 {
+			return nil, nil, errors.New("cannot connect")
+		}
+		return port, func() { closed <- port }, nil
+	}, WithCacherName("test"), WithBackgroundRebuild(10*time.Millisecond))
+
+	get := func() interface{} {
+		v, err := c.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := get(); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+
+	// The old object is served while the new one is built.
+	m.Set("port", 2)
+	if v := get(); v != 1 {
+		t.Fatalf("expected 1 during the rebuild, got %v", v)
+	}
+	close(block)
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("rebuild was not applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case port := <-closed:
+		if port != 1 {
+			t.Errorf("expected the old object to be closed, got %d", port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("old object was not closed")
+	}
+
+	// A failed rebuild keeps the old object.
+	m.Set("port", 3)
+	get()
+	time.Sleep(50 * time.Millisecond)
+	if v := get(); v != 2 {
+		t.Fatalf("expected 2 after a failed rebuild, got %v", v)
+	}
+}
+
+func TestCacher_GetInto(t *testing.T) {
+	type pool struct{ Size int }
+	m := NewMemory()
+	m.Set("size", 4)
+	c := NewCacher(m, func(cfg View) (interface{}, func(), error) {
+		return &pool{Size: cfg.GetInt("size")}, nil, nil
+	}, WithCacherName("test"))
+
+	var p *pool
+	if err := c.GetInto(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Size != 4 {
+		t.Fatalf("expected size 4, got %d", p.Size)
+	}
+	// An interface the object implements works too.
+	var obj interface{}
+	if err := c.GetInto(&obj); err != nil || obj != p {
+		t.Fatalf("expected the cached object, got %v, %v", obj, err)
+	}
+
+	var wrong *string
+	if err := c.GetInto(&wrong); err == nil {
+		t.Fatal("expected an error storing the object in another type")
+	}
+	if err := c.GetInto(p); err == nil {
+		t.Fatal("expected an error without a pointer to a variable of the object")
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ChangeFunc is called with the configuration before and after a reload.
+type ChangeFunc func(old, new View)
+
+// Watchable is a View which can notify about configuration reloads.
+type Watchable interface {
+	View
+	// Watch calls fn after each reload which changed the value of key, or of
+	// any key below it. An empty key watches the whole configuration. The
+	// returned function cancels the subscription.
+	Watch(key string, fn ChangeFunc) (cancel func())
+}
+
+// Watch subscribes fn to changes of key in v. If v cannot be watched, fn is
+// never called. The returned function cancels the subscription.
+func Watch(v View, key string, fn ChangeFunc) (cancel func()) {
+	if w, ok := v.(Watchable); ok {
+		return w.Watch(key, fn)
+	}
+	return func() {}
+}
+
+type subscription struct {
+	key string
+	fn  ChangeFunc
+}
+
+func (sub *subscription) notify(old, new *snapshot) {
+	var before, after interface{}
+	if sub.key == "" {
+		before, after = old.resolvedSettings(), new.resolvedSettings()
+	} else {
+		before, after = old.Get(sub.key), new.Get(sub.key)
+	}
+	if !reflect.DeepEqual(before, after) {
+		sub.fn(old, new)
+	}
+}
+
+// Watch implements Watchable.
+func (s *Store) Watch(key string, fn ChangeFunc) (cancel func()) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	id := s.nextSub
+	s.nextSub++
+	s.subs[id] = &subscription{
+		key: strings.ToLower(key),
+		fn:  fn,
+	}
+	return func() {
+		s.m.Lock()
+		defer s.m.Unlock()
+		delete(s.subs, id)
+	}
+}
@@ -0,0 +1,174 @@
+// Package filewatch notices changes of files, including the ones Kubernetes
+// makes to ConfigMap and Secret volumes by swapping a symlink.
+package filewatch
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDebounce is how long files should stop changing before they are
+	// read again. Kubernetes volume updates produce several events.
+	DefaultDebounce = 500 * time.Millisecond
+)
+
+var (
+	logger = logrus.WithFields(logrus.Fields{
+		"app":       "openmatch",
+		"component": "filewatch",
+	})
+)
+
+// Watcher calls a function when watched files change. The directories of the
+// files are watched instead of the files, so that replacing a file, or the
+// target of a symlink on its path, is noticed.
+type Watcher struct {
+	debounce time.Duration
+	changed  func()
+	failed   func(error)
+	watcher  *fsnotify.Watcher
+
+	m sync.Mutex
+	// realPaths maps the watched files to the files their symlinks resolved
+	// to when they were last seen.
+	realPaths map[string]string
+	// dirs are the directories whose entries accepted by match are watched.
+	dirs   []string
+	match  func(name string) bool
+	timer  *time.Timer
+	closed bool
+}
+
+// New returns a Watcher which calls changed once the watched files did not
+// change for debounce, or at once if debounce is 0. Errors of the underlying
+// watch are passed to failed. The Watcher watches no files until Watch.
+func New(debounce time.Duration, changed func(), failed func(error)) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		debounce: debounce,
+		changed:  changed,
+		failed:   failed,
+		watcher:  fw,
+	}
+	go w.run()
+	return w, nil
+}
+
+// Watch replaces the watched files with files, and the files in dirs accepted
+// by match. Directories which were watched before stay watched, but their
+// events are ignored.
+func (w *Watcher) Watch(files, dirs []string, match func(name string) bool) error {
+	realPaths := make(map[string]string, len(files))
+	for _, f := range files {
+		f = filepath.Clean(f)
+		realPaths[f], _ = filepath.EvalSymlinks(f)
+		if err := w.watcher.Add(filepath.Dir(f)); err != nil {
+			return err
+		}
+	}
+	cleanDirs := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		d = filepath.Clean(d)
+		cleanDirs = append(cleanDirs, d)
+		if err := w.watcher.Add(d); err != nil {
+			return err
+		}
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.realPaths = realPaths
+	w.dirs = cleanDirs
+	w.match = match
+	return nil
+}
+
+func (w *Watcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || !w.affects(event) {
+				continue
+			}
+			logger.WithFields(logrus.Fields{
+				"operation": event.Op.String(),
+				"filename":  event.Name,
+			}).Debug("watched file event")
+			w.Trigger()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if w.failed != nil {
+				w.failed(err)
+			}
+		}
+	}
+}
+
+// affects returns true if event changed one of the watched files, either
+// directly or by changing the target of a symlink on its path.
+func (w *Watcher) affects(event fsnotify.Event) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	name := filepath.Clean(event.Name)
+	changed := false
+	for _, d := range w.dirs {
+		if filepath.Dir(name) == d && (w.match == nil || w.match(name)) {
+			changed = true
+		}
+	}
+	for f, realPath := range w.realPaths {
+		current, _ := filepath.EvalSymlinks(f)
+		if f == name || current != realPath {
+			w.realPaths[f] = current
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Trigger calls the changed function of w as if a watched file changed,
+// debounced with the file events.
+func (w *Watcher) Trigger() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return
+	}
+	if w.debounce == 0 {
+		go w.changed()
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(w.debounce, w.changed)
+}
+
+// Close stops watching the files, and cancels a pending call of the changed
+// function.
+func (w *Watcher) Close() error {
+	w.m.Lock()
+	if w.closed {
+		w.m.Unlock()
+		return nil
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.m.Unlock()
+	return w.watcher.Close()
+}
@@ -0,0 +1,129 @@
+package filewatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWatcher returns a Watcher counting its calls on changes, and a
+// temporary directory.
+func newTestWatcher(t *testing.T, debounce time.Duration) (*Watcher, chan struct{}, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	changes := make(chan struct{}, 10)
+	w, err := New(debounce, func() { changes <- struct{}{} }, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, changes, dir
+}
+
+func write(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectChange(t *testing.T, changes chan struct{}) {
+	t.Helper()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not noticed")
+	}
+}
+
+func expectNoChange(t *testing.T, changes chan struct{}, wait time.Duration) {
+	t.Helper()
+	select {
+	case <-changes:
+		t.Fatal("unexpected change")
+	case <-time.After(wait):
+	}
+}
+
+func TestWatcher_Debounce(t *testing.T) {
+	w, changes, dir := newTestWatcher(t, 50*time.Millisecond)
+	file := filepath.Join(dir, "tls.crt")
+	write(t, file, "a")
+	if err := w.Watch([]string{file}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other files of the directory are ignored.
+	write(t, filepath.Join(dir, "other"), "a")
+	expectNoChange(t, changes, 200*time.Millisecond)
+
+	// Several writes in a row are one change.
+	write(t, file, "b")
+	write(t, file, "c")
+	expectChange(t, changes)
+	expectNoChange(t, changes, 200*time.Millisecond)
+}
+
+func TestWatcher_SymlinkSwap(t *testing.T) {
+	w, changes, dir := newTestWatcher(t, 0)
+	// Kubernetes volumes link the files to a data directory, whose link is
+	// swapped on updates.
+	for _, data := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(dir, data), 0700); err != nil {
+			t.Fatal(err)
+		}
+		write(t, filepath.Join(dir, data, "config.yaml"), data)
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Watch([]string{filepath.Join(dir, "config.yaml")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes)
+}
+
+func TestWatcher_Dirs(t *testing.T) {
+	w, changes, dir := newTestWatcher(t, 0)
+	if err := w.Watch(nil, []string{dir}, func(name string) bool { return strings.HasSuffix(name, ".yaml") }); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(dir, "notes.txt"), "a")
+	expectNoChange(t, changes, 200*time.Millisecond)
+	write(t, filepath.Join(dir, "10-fragment.yaml"), "a")
+	expectChange(t, changes)
+}
+
+func TestWatcher_Close(t *testing.T) {
+	w, changes, dir := newTestWatcher(t, 50*time.Millisecond)
+	file := filepath.Join(dir, "tls.crt")
+	write(t, file, "a")
+	if err := w.Watch([]string{file}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Trigger()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The pending change is canceled.
+	expectNoChange(t, changes, 200*time.Millisecond)
+	w.Trigger()
+	expectNoChange(t, changes, 100*time.Millisecond)
+}
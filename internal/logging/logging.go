@@ -9,6 +9,12 @@ import (
 	"siody.home/om-like/internal/config"
 )
 
+// ConfigFields describes the configuration keys read by this package.
+var ConfigFields = []config.Field{
+	{Key: "logging.level", Type: config.TypeString, Values: []string{"trace", "debug", "info", "warn", "warning", "error", "fatal", "panic"}},
+	{Key: "logging.format", Type: config.TypeString, Values: []string{"text", "json", "stackdriver"}},
+}
+
 // ConfigureLogging sets up open match logrus instance using the logging section of the matchmaker_config.json
 //  - log line format (text[default] or json)
 //  - min log level to include (debug, info [default], warn, error, fatal, panic)
@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// startAdminServer serves the admin mux of params on its admin listener, with
+// TLS if tlsConfig is set. Like the main port, the requests are authorized and
+// logged. It returns nil if there is no admin listener.
+func startAdminServer(params *ServerParams, tlsConfig *tls.Config) *http.Server {
+	if params.adminListener == nil {
+		return nil
+	}
+	server := &http.Server{
+		Addr:      params.adminListener.Addr().String(),
+		Handler:   instrumentHTTPHandler(params.AdminMux, params),
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		var l net.Listener = params.adminListener
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		serverLogger.Infof("Serving admin: %s", params.adminListener.Addr().String())
+		err := server.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			serverLogger.Debugf("error serving admin: %s", err)
+		}
+	}()
+	return server
+}
+
+// adminTLSConfig returns the TLS configuration of the admin server. It has the
+// client auth policy of the main port, unless params sets one for the admin
+// port, such as for probes and metrics scrapers without client certificates.
+func adminTLSConfig(base *tls.Config, certs *certStore, params *ServerParams) *tls.Config {
+	cfg := base.Clone()
+	if params.adminClientAuth != nil && *params.adminClientAuth != cfg.ClientAuth {
+		serverLogger.Infof("Admin port client authentication is %s instead of %s", *params.adminClientAuth, cfg.ClientAuth)
+		cfg.ClientAuth = *params.adminClientAuth
+	}
+	cfg.GetConfigForClient = certs.configForClient(cfg)
+	return cfg
+}
+
+// closeAdminServer closes server, if any. It is called after the main server
+// drained, so that the readiness probe stays reachable until then.
+func closeAdminServer(server *http.Server) error {
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
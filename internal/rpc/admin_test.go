@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"siody.home/om-like/internal/config"
+)
+
+// startAdminTestServer starts a server with an admin port from cfg, authorizing
+// the requests with adminOnly. It returns the address of the admin port, whose
+// /debug handler answers ok.
+func startAdminTestServer(t *testing.T, cfg *config.Memory) string {
+	t.Helper()
+	cfg.Set("api.test.httpport", 0)
+	cfg.Set("api.test.adminport", 1)
+	p, err := NewServerParamsFromConfig(cfg, "api.test", listenLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasAdminPort() {
+		t.Fatal("expected an admin port")
+	}
+	p.SetAuthorizer(adminOnly)
+	p.AdminMux.HandleFunc("/debug", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	addr := p.adminListener.Addr().String()
+	startServer(t, p)
+	return addr
+}
+
+// tlsAdminConfig returns the TLS settings of a server requiring client
+// certificates, with the admin client auth mode adminClientAuth if set.
+func tlsAdminConfig(t *testing.T, ca *testCA, adminClientAuth string) *config.Memory {
+	_, write := tempDir(t)
+	cert, key := ca.issue(t, testCertificate{commonName: "server"})
+	cfg := config.NewMemory()
+	cfg.Set(configNameServerRootCertificatePath, write("ca.crt", ca.certPEM))
+	cfg.Set(configNameServerPublicCertificateFile, write("tls.crt", cert))
+	cfg.Set(configNameServerPrivateKeyFile, write("tls.key", key))
+	cfg.Set(configNameServerClientAuth, ClientAuthRequire)
+	if adminClientAuth != "" {
+		cfg.Set(configNameServerAdminClientAuth, adminClientAuth)
+	}
+	return cfg
+}
+
+func TestAdminServer_ClientAuth(t *testing.T) {
+	ca := newTestCA(t, "root")
+	adminCert, adminKey := ca.issue(t, testCertificate{commonName: "admin"})
+	userCert, userKey := ca.issue(t, testCertificate{commonName: "user"})
+
+	tests := []struct {
+		name            string
+		adminClientAuth string
+		config          *tls.Config
+		// status is the HTTP status of the request, or 0 if the handshake
+		// fails.
+		status int
+	}{
+		{name: "admin", config: ca.clientConfig(t, adminCert, adminKey), status: http.StatusOK},
+		{name: "denied", config: ca.clientConfig(t, userCert, userKey), status: http.StatusForbidden},
+		{name: "no certificate", config: ca.clientConfig(t), status: 0},
+		{name: "opt-in admin", adminClientAuth: ClientAuthRequest, config: ca.clientConfig(t, adminCert, adminKey), status: http.StatusOK},
+		{name: "opt-in no certificate", adminClientAuth: ClientAuthRequest, config: ca.clientConfig(t), status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startAdminTestServer(t, tlsAdminConfig(t, ca, tt.adminClientAuth))
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.config}}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get("https://" + addr + "/debug")
+			if tt.status == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("expected the request without a client certificate to fail, got %s", resp.Status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected HTTP status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAdminServer_InsecureAuthorizer(t *testing.T) {
+	addr := startAdminTestServer(t, config.NewMemory())
+	if code, body := getBody(t, http.DefaultClient, "http://"+addr+"/debug"); code != http.StatusForbidden {
+		t.Fatalf("expected the Authorizer to deny the request, got %d %q", code, body)
+	}
+}
+
+func TestNewServerParamsFromConfig_AdminClientAuth(t *testing.T) {
+	ca := newTestCA(t, "root")
+	cfg := tlsAdminConfig(t, ca, "optional")
+	cfg.Set("api.test.httpport", 0)
+	if _, err := NewServerParamsFromConfig(cfg, "api.test", listenLocal); err == nil {
+		t.Fatal("expected an unknown admin client auth mode to fail")
+	}
+}
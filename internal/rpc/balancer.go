@@ -0,0 +1,401 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"siody.home/om-like/internal/config"
+	"siody.home/om-like/internal/telemetry"
+)
+
+const (
+	// BalancerRoundRobin sends the requests to the endpoints in turn.
+	BalancerRoundRobin = "roundRobin"
+	// BalancerLeastOutstanding sends a request to the endpoint with the fewest
+	// requests in flight.
+	BalancerLeastOutstanding = "leastOutstanding"
+	// BalancerConsistentHash sends the requests with the same key to the same
+	// endpoint, as long as it is healthy.
+	BalancerConsistentHash = "consistentHash"
+
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = time.Second
+	defaultDNSRefreshInterval  = 30 * time.Second
+	// defaultHashKeyHeader is the header holding the key of consistentHash.
+	// Requests without it are hashed by path.
+	defaultHashKeyHeader = "X-Hash-Key"
+	// hashReplicas is the number of points of each endpoint on the hash ring.
+	hashReplicas = 100
+)
+
+var (
+	balancerConfigFields = append([]config.Field{
+		{Key: "api.*.endpoints", Type: config.TypeStringSlice},
+	}, clientSettingFields(
+		config.Field{Key: "balancer.policy", Type: config.TypeString, Values: []string{BalancerRoundRobin, BalancerLeastOutstanding, BalancerConsistentHash}},
+		config.Field{Key: "balancer.hashHeader", Type: config.TypeString},
+		config.Field{Key: "balancer.dnsRefresh", Type: config.TypeDuration},
+		config.Field{Key: "healthCheck.interval", Type: config.TypeDuration},
+		config.Field{Key: "healthCheck.timeout", Type: config.TypeDuration},
+	)...)
+
+	mHealthyEndpoints = stats.Int64("rpc/client_healthy_endpoints", "Number of healthy endpoints of a target", stats.UnitDimensionless)
+
+	healthyEndpointsView = &view.View{
+		Measure:     mHealthyEndpoints,
+		Name:        "rpc/client_healthy_endpoints",
+		Description: "Number of healthy endpoints of a target",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyTarget},
+	}
+)
+
+type endpoint struct {
+	addr        string
+	healthy     bool
+	outstanding int64
+}
+
+// balancer spreads the requests to the host of a target over its endpoints,
+// which are configured in <prefix>.endpoints or resolved from the hostname.
+// The endpoints are checked with the readiness probe of the health check, and
+// left out while they fail it. If every endpoint fails, all of them are used.
+type balancer struct {
+	base       http.RoundTripper
+	target     string
+	host       string
+	scheme     string
+	policy     string
+	hashHeader string
+	// checkPort is the admin port of the endpoints, which serves the health
+	// check, or empty if they serve it on the HTTP port.
+	checkPort string
+
+	m         sync.RWMutex
+	endpoints map[string]*endpoint
+	healthy   []*endpoint
+	ring      []ringPoint
+	next      uint64
+
+	checkClient *http.Client
+	stop        chan struct{}
+}
+
+type ringPoint struct {
+	hash uint32
+	ep   *endpoint
+}
+
+// newBalancerFromConfig returns the balancer of the target at prefix, or nil
+// if the target has neither endpoints nor a balancer policy. host is the host
+// of the requests to balance.
+func newBalancerFromConfig(cfg config.View, prefix, host, scheme string, base, checkTransport http.RoundTripper) (*balancer, error) {
+	addrs := cfg.GetStringSlice(prefix + ".endpoints")
+	policy := clientString(cfg, prefix, "balancer.policy", "")
+	if len(addrs) == 0 && policy == "" {
+		return nil, nil
+	}
+	if policy == "" {
+		policy = BalancerRoundRobin
+	}
+	switch policy {
+	case BalancerRoundRobin, BalancerLeastOutstanding, BalancerConsistentHash:
+	default:
+		return nil, fmt.Errorf("invalid balancer policy %q of %s, expected %s, %s or %s", policy, prefix, BalancerRoundRobin, BalancerLeastOutstanding, BalancerConsistentHash)
+	}
+
+	b := &balancer{
+		base:       base,
+		target:     prefix,
+		host:       host,
+		scheme:     scheme,
+		policy:     policy,
+		hashHeader: clientString(cfg, prefix, "balancer.hashHeader", defaultHashKeyHeader),
+		endpoints:  make(map[string]*endpoint),
+		checkClient: &http.Client{
+			Transport: checkTransport,
+			Timeout:   clientDuration(cfg, prefix, "healthCheck.timeout", defaultHealthCheckTimeout),
+		},
+		stop: make(chan struct{}),
+	}
+	if adminPort := cfg.GetInt(prefix + ".adminport"); adminPort > 0 && adminPort != cfg.GetInt(prefix+".httpport") {
+		b.checkPort = fmt.Sprint(adminPort)
+	}
+
+	var resolve func() ([]string, error)
+	if len(addrs) == 0 {
+		hostname, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return nil, err
+		}
+		resolve = func() ([]string, error) {
+			ips, err := net.DefaultResolver.LookupHost(context.Background(), hostname)
+			if err != nil {
+				return nil, err
+			}
+			for i, ip := range ips {
+				ips[i] = net.JoinHostPort(ip, port)
+			}
+			return ips, nil
+		}
+		if addrs, err = resolve(); err != nil {
+			return nil, fmt.Errorf("cannot resolve the endpoints of %s, %s", prefix, err)
+		}
+	}
+	b.setEndpoints(addrs)
+
+	go b.run(clientDuration(cfg, prefix, "healthCheck.interval", defaultHealthCheckInterval),
+		clientDuration(cfg, prefix, "balancer.dnsRefresh", defaultDNSRefreshInterval), resolve)
+	return b, nil
+}
+
+// setEndpoints replaces the endpoints, keeping the state of the ones which
+// remain.
+func (b *balancer) setEndpoints(addrs []string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	endpoints := make(map[string]*endpoint, len(addrs))
+	for _, addr := range addrs {
+		if ep, ok := b.endpoints[addr]; ok {
+			endpoints[addr] = ep
+		} else {
+			endpoints[addr] = &endpoint{addr: addr, healthy: true}
+		}
+	}
+	b.endpoints = endpoints
+	b.update()
+}
+
+// update rebuilds the list of endpoints to use and the hash ring. b.m must be
+// held.
+func (b *balancer) update() {
+	var healthy, all []*endpoint
+	for _, ep := range b.endpoints {
+		all = append(all, ep)
+		if ep.healthy {
+			healthy = append(healthy, ep)
+		}
+	}
+	recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, b.target)}, mHealthyEndpoints.M(int64(len(healthy))))
+	if len(healthy) == 0 {
+		healthy = all
+	}
+	sort.Slice(healthy, func(i, j int) bool { return healthy[i].addr < healthy[j].addr })
+	b.healthy = healthy
+
+	if b.policy != BalancerConsistentHash {
+		return
+	}
+	b.ring = b.ring[:0]
+	for _, ep := range healthy {
+		for i := 0; i < hashReplicas; i++ {
+			b.ring = append(b.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", ep.addr, i)), ep: ep})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// hashString hashes s with FNV-1a and the finalizer of MurmurHash3, as FNV
+// alone clusters keys which differ only at the end, such as ports.
+func hashString(s string) uint32 {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, s)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+// pick returns the endpoint of req, or nil if there is none.
+func (b *balancer) pick(req *http.Request) *endpoint {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if len(b.healthy) == 0 {
+		return nil
+	}
+
+	switch b.policy {
+	case BalancerLeastOutstanding:
+		// Start at the next endpoint in turn, so that ties are spread.
+		start := int(atomic.AddUint64(&b.next, 1) % uint64(len(b.healthy)))
+		best := b.healthy[start]
+		for i := 1; i < len(b.healthy); i++ {
+			ep := b.healthy[(start+i)%len(b.healthy)]
+			if atomic.LoadInt64(&ep.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = ep
+			}
+		}
+		return best
+	case BalancerConsistentHash:
+		key := req.Header.Get(b.hashHeader)
+		if key == "" {
+			key = req.URL.Path
+		}
+		h := hashString(key)
+		i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		if i == len(b.ring) {
+			i = 0
+		}
+		return b.ring[i].ep
+	}
+	return b.healthy[atomic.AddUint64(&b.next, 1)%uint64(len(b.healthy))]
+}
+
+// RoundTrip sends requests to the host of the target to one of its
+// endpoints. The Host header keeps the name of the target.
+func (b *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != b.host {
+		return b.base.RoundTrip(req)
+	}
+	ep := b.pick(req)
+	if ep == nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("no endpoints of %s", b.target)
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Host = ep.addr
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	atomic.AddInt64(&ep.outstanding, 1)
+	resp, err := b.base.RoundTrip(out)
+	if err != nil {
+		atomic.AddInt64(&ep.outstanding, -1)
+		return nil, err
+	}
+	resp.Body = &outstandingBody{ReadCloser: resp.Body, ep: ep}
+	return resp, nil
+}
+
+// outstandingBody counts its request as outstanding until it is closed.
+type outstandingBody struct {
+	io.ReadCloser
+	ep   *endpoint
+	once sync.Once
+}
+
+func (b *outstandingBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.ep.outstanding, -1) })
+	return b.ReadCloser.Close()
+}
+
+// run checks the health of the endpoints every interval and, if resolve is
+// set, refreshes them every refresh, until close.
+func (b *balancer) run(interval, refresh time.Duration, resolve func() ([]string, error)) {
+	check := time.NewTicker(interval)
+	defer check.Stop()
+	var refreshC <-chan time.Time
+	if resolve != nil {
+		t := time.NewTicker(refresh)
+		defer t.Stop()
+		refreshC = t.C
+	}
+
+	b.checkAll()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-check.C:
+			b.checkAll()
+		case <-refreshC:
+			addrs, err := resolve()
+			if err != nil {
+				clientLogger.WithError(err).WithField("target", b.target).Warning("cannot refresh the endpoints, keeping the current ones")
+				continue
+			}
+			b.setEndpoints(addrs)
+		}
+	}
+}
+
+func (b *balancer) checkAll() {
+	b.m.RLock()
+	endpoints := make([]*endpoint, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		endpoints = append(endpoints, ep)
+	}
+	b.m.RUnlock()
+
+	results := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range endpoints {
+		wg.Add(1)
+		go func(i int, ep *endpoint) {
+			defer wg.Done()
+			results[i] = b.check(ep)
+		}(i, ep)
+	}
+	wg.Wait()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	changed := false
+	for i, ep := range endpoints {
+		healthy := results[i] == nil
+		if ep.healthy == healthy {
+			continue
+		}
+		ep.healthy = healthy
+		changed = true
+		fields := logrus.Fields{"target": b.target, "endpoint": ep.addr}
+		if healthy {
+			clientLogger.WithFields(fields).Info("endpoint is healthy again")
+		} else {
+			clientLogger.WithError(results[i]).WithFields(fields).Warning("endpoint is unhealthy")
+		}
+	}
+	if changed {
+		b.update()
+	}
+}
+
+// check probes the readiness of ep.
+func (b *balancer) check(ep *endpoint) error {
+	addr := ep.addr
+	if b.checkPort != "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = net.JoinHostPort(host, b.checkPort)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s%s?ready", b.scheme, addr, telemetry.HealthCheckEndpoint), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = b.host
+	resp, err := b.checkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s, %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// close stops the health checks.
+func (b *balancer) close() {
+	close(b.stop)
+}
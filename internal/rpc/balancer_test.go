@@ -0,0 +1,255 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"siody.home/om-like/internal/config"
+	"siody.home/om-like/internal/telemetry"
+)
+
+// newTestBalancer returns a balancer of addrs which does not check them.
+func newTestBalancer(policy string, addrs ...string) *balancer {
+	b := &balancer{
+		target:     "api.test",
+		host:       "test:8081",
+		scheme:     "http",
+		policy:     policy,
+		hashHeader: defaultHashKeyHeader,
+		endpoints:  make(map[string]*endpoint),
+		stop:       make(chan struct{}),
+	}
+	b.setEndpoints(addrs)
+	return b
+}
+
+func pickAddr(b *balancer, key string) string {
+	req, _ := http.NewRequest(http.MethodGet, "http://test:8081/", nil)
+	if key != "" {
+		req.Header.Set(defaultHashKeyHeader, key)
+	}
+	return b.pick(req).addr
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := newTestBalancer(BalancerRoundRobin, "a:1", "b:1", "c:1")
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		counts[pickAddr(b, "")]++
+	}
+	for _, addr := range []string{"a:1", "b:1", "c:1"} {
+		if counts[addr] != 2 {
+			t.Fatalf("expected 2 requests to each endpoint, got %v", counts)
+		}
+	}
+}
+
+func TestBalancer_LeastOutstanding(t *testing.T) {
+	b := newTestBalancer(BalancerLeastOutstanding, "a:1", "b:1", "c:1")
+	b.endpoints["a:1"].outstanding = 3
+	b.endpoints["c:1"].outstanding = 1
+	b.endpoints["b:1"].outstanding = 2
+	for i := 0; i < 3; i++ {
+		if addr := pickAddr(b, ""); addr != "c:1" {
+			t.Fatalf("expected the endpoint with the fewest requests, got %s", addr)
+		}
+	}
+}
+
+func TestBalancer_ConsistentHash(t *testing.T) {
+	b := newTestBalancer(BalancerConsistentHash, "a:1", "b:1", "c:1")
+	before := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		before[key] = pickAddr(b, key)
+		if again := pickAddr(b, key); again != before[key] {
+			t.Fatalf("expected %s to stay on %s, got %s", key, before[key], again)
+		}
+	}
+
+	// Only the keys of a removed endpoint move.
+	b.setEndpoints([]string{"a:1", "b:1"})
+	for key, addr := range before {
+		if after := pickAddr(b, key); addr != "c:1" && after != addr {
+			t.Fatalf("expected %s to stay on %s, got %s", key, addr, after)
+		}
+	}
+}
+
+// testEndpoint is an HTTP server answering its name, whose readiness probe
+// fails while unhealthy is set, and counts the probes.
+type testEndpoint struct {
+	*httptest.Server
+	unhealthy int32
+	probes    int32
+}
+
+func newTestEndpoint(t *testing.T, name string) *testEndpoint {
+	ep := newUnstartedTestEndpoint(t, name)
+	ep.Start()
+	return ep
+}
+
+// newTLSTestEndpoint returns a testEndpoint serving HTTPS with the PEM
+// certificate and key.
+func newTLSTestEndpoint(t *testing.T, name string, cert, key []byte) *testEndpoint {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := newUnstartedTestEndpoint(t, name)
+	ep.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	ep.StartTLS()
+	return ep
+}
+
+func newUnstartedTestEndpoint(t *testing.T, name string) *testEndpoint {
+	ep := &testEndpoint{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(telemetry.HealthCheckEndpoint, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&ep.probes, 1)
+		if atomic.LoadInt32(&ep.unhealthy) == 1 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, req.Host)
+	})
+	ep.Server = httptest.NewUnstartedServer(mux)
+	t.Cleanup(ep.Close)
+	return ep
+}
+
+func (ep *testEndpoint) addr() string {
+	return ep.Listener.Addr().String()
+}
+
+// waitHealthy waits until b uses n endpoints.
+func waitHealthy(t *testing.T, b *balancer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.m.RLock()
+		healthy := len(b.healthy)
+		b.m.RUnlock()
+		if healthy == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d healthy endpoints, got %d", n, healthy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func endpointHealthy(b *balancer, addr string) bool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.endpoints[addr].healthy
+}
+
+func TestHTTPClient_Balancer(t *testing.T) {
+	one, two := newTestEndpoint(t, "one"), newTestEndpoint(t, "two")
+	cfg := config.NewMemory()
+	cfg.Set("api.test.hostname", "test")
+	cfg.Set("api.test.httpport", 8081)
+	cfg.Set("api.test.endpoints", []string{one.addr(), two.addr()})
+	cfg.Set("api.test.client.healthCheck.interval", "10ms")
+	cfg.Set("api.test.client.breaker.failureThreshold", 0)
+	client, err := HTTPClientFromConfig(cfg, "api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	get := func() string {
+		_, body := getBody(t, client.Client, client.BaseURL+"/")
+		return body
+	}
+	// The requests are spread over the endpoints, naming the target.
+	seen := map[string]bool{get(): true, get(): true}
+	if !seen["one test:8081"] || !seen["two test:8081"] {
+		t.Fatalf("expected both endpoints with the Host of the target, got %v", seen)
+	}
+
+	// An endpoint failing its readiness probe is left out until it recovers.
+	atomic.StoreInt32(&two.unhealthy, 1)
+	waitHealthy(t, client.balancer, 1)
+	for i := 0; i < 4; i++ {
+		if body := get(); body != "one test:8081" {
+			t.Fatalf("expected the healthy endpoint, got %q", body)
+		}
+	}
+	atomic.StoreInt32(&two.unhealthy, 0)
+	waitHealthy(t, client.balancer, 2)
+
+	// If every endpoint fails, all of them are used.
+	atomic.StoreInt32(&one.unhealthy, 1)
+	atomic.StoreInt32(&two.unhealthy, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for endpointHealthy(client.balancer, one.addr()) || endpointHealthy(client.balancer, two.addr()) {
+		if time.Now().After(deadline) {
+			t.Fatal("the endpoints were not found unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitHealthy(t, client.balancer, 2)
+}
+
+func TestHTTPClient_BalancerTLS(t *testing.T) {
+	// The endpoints present a certificate of the hostname only, which is not
+	// valid for their addresses.
+	ca := newTestCA(t, "root")
+	cert, key := ca.issue(t, testCertificate{commonName: "test", dnsNames: []string{"test"}, noIPAddresses: true})
+	one, two := newTLSTestEndpoint(t, "one", cert, key), newTLSTestEndpoint(t, "two", cert, key)
+	_, write := tempDir(t)
+	cfg := config.NewMemory()
+	cfg.Set(configNameServerRootCertificatePath, write("ca.crt", ca.certPEM))
+	cfg.Set("api.test.hostname", "test")
+	cfg.Set("api.test.httpport", 8081)
+	cfg.Set("api.test.endpoints", []string{one.addr(), two.addr()})
+	// Only the first probes run, which start with the client.
+	cfg.Set("api.test.client.healthCheck.interval", "1h")
+	cfg.Set("api.test.client.breaker.failureThreshold", 0)
+	client, err := HTTPClientFromConfig(cfg, "api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The first probes verify the certificate against the hostname.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&one.probes) == 0 || atomic.LoadInt32(&two.probes) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first probes did not reach the endpoints")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := func() string {
+		_, body := getBody(t, client.Client, client.BaseURL+"/")
+		return body
+	}
+	seen := map[string]bool{get(): true, get(): true}
+	if !seen["one test:8081"] || !seen["two test:8081"] {
+		t.Fatalf("expected both endpoints with the Host of the target, got %v", seen)
+	}
+	if !endpointHealthy(client.balancer, one.addr()) || !endpointHealthy(client.balancer, two.addr()) {
+		t.Fatal("expected both endpoints to stay healthy")
+	}
+}
+
+func TestHTTPClientFromConfig_EndpointsRequireHostname(t *testing.T) {
+	cfg := config.NewMemory()
+	cfg.Set("api.test.endpoints", []string{"10.0.0.1:8081", "10.0.0.2:8081"})
+	_, err := HTTPClientFromConfig(cfg, "api.test")
+	if err == nil || !strings.Contains(err.Error(), "api.test.endpoints requires api.test.hostname") {
+		t.Fatalf("expected the hostname to be required, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	serial  int64
+}
+
+// testCertificate describes a certificate issued by testCA.
+type testCertificate struct {
+	commonName string
+	dnsNames   []string
+	uris       []string
+	notAfter   time.Time
+	// extKeyUsage defaults to server and client authentication.
+	extKeyUsage []x509.ExtKeyUsage
+	// noIPAddresses leaves out the 127.0.0.1 IP SAN, so that the certificate
+	// is only valid for its names.
+	noIPAddresses bool
+}
+
+func newTestCA(t *testing.T, commonName string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial:  1,
+	}
+}
+
+// issue returns the PEM certificate and key of c, valid for servers on
+// localhost, and 127.0.0.1 unless c.noIPAddresses is set, and, unless
+// c.extKeyUsage leaves it out, for clients.
+func (ca *testCA) issue(t *testing.T, c testCertificate) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.notAfter.IsZero() {
+		c.notAfter = time.Now().Add(24 * time.Hour)
+	}
+	if c.extKeyUsage == nil {
+		c.extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: c.commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     c.notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  c.extKeyUsage,
+		DNSNames:     append([]string{"localhost"}, c.dnsNames...),
+	}
+	if !c.noIPAddresses {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	for _, u := range c.uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientConfig returns a tls.Config trusting ca, presenting the certificates
+// certAndKey if given.
+func (ca *testCA) clientConfig(t *testing.T, certAndKey ...[]byte) *tls.Config {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if len(certAndKey) == 2 {
+		cert, err := tls.X509KeyPair(certAndKey[0], certAndKey[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg
+}
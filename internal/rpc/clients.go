@@ -1,7 +1,21 @@
 package rpc
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"siody.home/om-like/internal/config"
+	"siody.home/om-like/internal/logging"
 )
 
 const (
@@ -9,6 +23,17 @@ const (
 	ConfigNameEnableRPCLogging = "logging.rpc"
 	// configNameClientTrustedCertificatePath is the same as the root CA cert that the server trusts.
 	configNameClientTrustedCertificatePath = configNameServerRootCertificatePath
+
+	// configNameClientDefaults is the section of the client settings which
+	// apply to every target. A target overrides them in its own client
+	// section, such as api.test.client.timeout.
+	configNameClientDefaults = "api.client"
+
+	defaultClientTimeout             = 10 * time.Second
+	defaultClientDialTimeout         = 5 * time.Second
+	defaultClientTLSHandshakeTimeout = 5 * time.Second
+	defaultClientIdleConnTimeout     = 90 * time.Second
+	defaultClientMaxIdleConnsPerHost = 16
 )
 
 var (
@@ -16,4 +41,302 @@ var (
 		"app":       "openmatch",
 		"component": "client",
 	})
+
+	clientConfigFields = append([]config.Field{
+		{Key: "api.*.hostname", Type: config.TypeString},
+	}, clientSettingFields(
+		config.Field{Key: "timeout", Type: config.TypeDuration},
+		config.Field{Key: "dialTimeout", Type: config.TypeDuration},
+		config.Field{Key: "tlsHandshakeTimeout", Type: config.TypeDuration},
+		config.Field{Key: "idleConnTimeout", Type: config.TypeDuration},
+		config.Field{Key: "maxIdleConnsPerHost", Type: config.TypeInt, Range: &config.Range{Min: 0, Max: 1 << 16}},
+	)...)
 )
+
+// clientSettingFields returns the fields of client settings, both in the
+// section of all targets and in the client sections of the targets.
+func clientSettingFields(settings ...config.Field) []config.Field {
+	var fields []config.Field
+	for _, f := range settings {
+		name := f.Key
+		f.Key = configNameClientDefaults + "." + name
+		fields = append(fields, f)
+		f.Key = "api.*.client." + name
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// HTTPClient is an HTTP client of a target service, such as api.test.
+type HTTPClient struct {
+	*http.Client
+	// BaseURL is the scheme, host and port of the target, such as
+	// https://test:8081.
+	BaseURL string
+
+	transport *http.Transport
+	balancer  *balancer
+	certs     *certStore
+}
+
+// Close stops the health checks of the endpoints and the watch of the client
+// certificate, and closes the idle connections.
+func (c *HTTPClient) Close() {
+	if c.balancer != nil {
+		c.balancer.close()
+	}
+	if c.certs != nil {
+		c.certs.close()
+	}
+	c.transport.CloseIdleConnections()
+}
+
+// HTTPClientCache builds the HTTP clients of target services from the
+// configuration, and rebuilds a client when the configuration it was built
+// from changes.
+type HTTPClientCache struct {
+	cfg config.View
+
+	m       sync.Mutex
+	cachers map[string]*config.Cacher
+}
+
+// NewHTTPClientCache returns an HTTPClientCache reading the configuration
+// from cfg.
+func NewHTTPClientCache(cfg config.View) *HTTPClientCache {
+	return &HTTPClientCache{
+		cfg:     cfg,
+		cachers: make(map[string]*config.Cacher),
+	}
+}
+
+// Get returns the client of the target service configured at prefix, such as
+// api.test.
+func (c *HTTPClientCache) Get(prefix string) (*HTTPClient, error) {
+	c.m.Lock()
+	cacher, ok := c.cachers[prefix]
+	if !ok {
+		cacher = config.NewCacher(c.cfg, func(cfg config.View) (interface{}, func(), error) {
+			client, err := HTTPClientFromConfig(cfg, prefix)
+			if err != nil {
+				return nil, nil, err
+			}
+			return client, client.Close, nil
+		}, config.WithCacherName("http_client_"+prefix))
+		c.cachers[prefix] = cacher
+	}
+	c.m.Unlock()
+
+	var client *HTTPClient
+	if err := cacher.GetInto(&client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close closes all the clients.
+func (c *HTTPClientCache) Close() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, cacher := range c.cachers {
+		cacher.ForceReset()
+	}
+}
+
+// HTTPClientFromConfig returns a client of the target service configured at
+// prefix. The client trusts the root CA of the server, propagates b3 trace
+// headers, and logs requests if RPC logging is enabled. With mutual TLS, it
+// presents the server certificate, reloaded when its files change. Failed
+// requests are retried, and may be hedged and cut off by a circuit breaker, as
+// configured for the target. With <prefix>.endpoints or a balancer policy, the
+// requests are spread over the healthy endpoints of the target, which keep the
+// hostname in the Host header and as the TLS server name.
+func HTTPClientFromConfig(cfg config.View, prefix string) (*HTTPClient, error) {
+	hostname := cfg.GetString(prefix + ".hostname")
+	endpoints := cfg.GetStringSlice(prefix + ".endpoints")
+	switch {
+	case hostname == "" && len(endpoints) == 0:
+		return nil, fmt.Errorf("cannot create a client of %s, neither %s.hostname nor %s.endpoints is set", prefix, prefix, prefix)
+	case hostname == "":
+		// The endpoints are addresses, which name neither the target in the
+		// Host header nor the certificate it presents.
+		return nil, fmt.Errorf("cannot create a client of %s, %s.endpoints requires %s.hostname, the name of the target", prefix, prefix, prefix)
+	}
+	host := net.JoinHostPort(hostname, fmt.Sprint(cfg.GetInt(prefix+".httpport")))
+
+	dialer := &net.Dialer{
+		Timeout:   clientDuration(cfg, prefix, "dialTimeout", defaultClientDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: clientDuration(cfg, prefix, "tlsHandshakeTimeout", defaultClientTLSHandshakeTimeout),
+		IdleConnTimeout:     clientDuration(cfg, prefix, "idleConnTimeout", defaultClientIdleConnTimeout),
+		MaxIdleConnsPerHost: clientInt(cfg, prefix, "maxIdleConnsPerHost", defaultClientMaxIdleConnsPerHost),
+		ForceAttemptHTTP2:   true,
+	}
+
+	scheme := "http"
+	tlsConfig, certs, err := clientTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		scheme = "https"
+		// The endpoints of a balancer are addresses, but present the
+		// certificate of the hostname. It is set before the balancer starts
+		// probing them with the transport.
+		tlsConfig.ServerName = hostname
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	lb, err := newBalancerFromConfig(cfg, prefix, host, scheme, nil, transport)
+	if err != nil {
+		if certs != nil {
+			certs.close()
+		}
+		return nil, err
+	}
+
+	var rt http.RoundTripper = &ochttp.Transport{
+		Base:        transport,
+		Propagation: &b3.HTTPFormat{},
+	}
+	if cfg.GetBool(ConfigNameEnableRPCLogging) {
+		rt = &loggingHTTPTransport{
+			base:        rt,
+			logPayloads: logging.IsDebugEnabled(cfg),
+		}
+	}
+	rt = resilientTransport(cfg, prefix, rt, lb)
+
+	return &HTTPClient{
+		Client: &http.Client{
+			Transport: rt,
+			Timeout:   clientDuration(cfg, prefix, "timeout", defaultClientTimeout),
+		},
+		BaseURL:   fmt.Sprintf("%s://%s", scheme, host),
+		transport: transport,
+		balancer:  lb,
+		certs:     certs,
+	}, nil
+}
+
+// clientTLSConfig returns the TLS configuration of clients, or nil if the
+// servers do not use TLS. Like the server, the client trusts the certificate
+// itself if there is no root CA. With mutual TLS, the client presents the
+// server certificate if it is valid for client authentication, which it must
+// be if the servers require client certificates, and the store of the
+// certificate is also returned, which must be closed.
+func clientTLSConfig(cfg config.View) (*tls.Config, *certStore, error) {
+	rootFile := cfg.GetString(configNameClientTrustedCertificatePath)
+	certFile := cfg.GetString(configNameServerPublicCertificateFile)
+	keyFile := cfg.GetString(configNameServerPrivateKeyFile)
+	if rootFile == "" {
+		rootFile = certFile
+	}
+	if rootFile == "" {
+		return nil, nil, nil
+	}
+
+	rootData, err := ioutil.ReadFile(rootFile)
+	if err != nil {
+		return nil, nil, errors.WithStack(fmt.Errorf("cannot read TLS root certificate file, %s, %s", rootFile, err))
+	}
+	roots, err := trustedCertificateFromFileData(rootData)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	clientAuth, _ := clientAuthType(cfg.GetString(configNameServerClientAuth))
+	if clientAuth == tls.NoClientCert || certFile == "" || keyFile == "" {
+		return tlsConfig, nil, nil
+	}
+	// The certificate is rotated with the one of the server.
+	certs, err := newClientCertStore(cfg.GetString(configNameClientTrustedCertificatePath), certFile, keyFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot load TLS client certificate")
+	}
+	cert, _ := certs.current()
+	if err := checkClientCertificate(cert.Leaf); err != nil {
+		certs.close()
+		if clientAuth == tls.RequireAndVerifyClientCert {
+			return nil, nil, errors.Wrap(err, "cannot present the server certificate as TLS client certificate")
+		}
+		// The servers do not require a client certificate.
+		clientLogger.WithError(err).Warning("TLS clients do not present the server certificate")
+		return tlsConfig, nil, nil
+	}
+	tlsConfig.GetClientCertificate = certs.getClientCertificate
+	return tlsConfig, certs, nil
+}
+
+// clientDuration returns the client setting name of the target at prefix,
+// or of all targets, or def.
+func clientDuration(cfg config.View, prefix, name string, def time.Duration) time.Duration {
+	for _, k := range []string{prefix + ".client." + name, configNameClientDefaults + "." + name} {
+		if cfg.IsSet(k) {
+			return cfg.GetDuration(k)
+		}
+	}
+	return def
+}
+
+// clientInt is clientDuration for integer settings.
+func clientInt(cfg config.View, prefix, name string, def int) int {
+	for _, k := range []string{prefix + ".client." + name, configNameClientDefaults + "." + name} {
+		if cfg.IsSet(k) {
+			return cfg.GetInt(k)
+		}
+	}
+	return def
+}
+
+// clientString is clientDuration for string settings.
+func clientString(cfg config.View, prefix, name string, def string) string {
+	for _, k := range []string{prefix + ".client." + name, configNameClientDefaults + "." + name} {
+		if cfg.IsSet(k) {
+			return cfg.GetString(k)
+		}
+	}
+	return def
+}
+
+// clientFloat is clientDuration for float settings.
+func clientFloat(cfg config.View, prefix, name string, def float64) float64 {
+	for _, k := range []string{prefix + ".client." + name, configNameClientDefaults + "." + name} {
+		if cfg.IsSet(k) {
+			return cfg.GetFloat64(k)
+		}
+	}
+	return def
+}
+
+type loggingHTTPTransport struct {
+	base        http.RoundTripper
+	logPayloads bool
+}
+
+func (l *loggingHTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	fields := logrus.Fields{
+		"method": req.Method,
+		"url":    req.URL.String(),
+	}
+	if l.logPayloads {
+		if dump, err := httputil.DumpRequestOut(req, true); err == nil {
+			clientLogger.WithFields(fields).Debug(string(dump))
+		}
+	}
+	resp, err := l.base.RoundTrip(req)
+	fields["duration"] = time.Since(start).String()
+	if err != nil {
+		clientLogger.WithError(err).WithFields(fields).Debug("HTTP request failed")
+		return nil, err
+	}
+	fields["status"] = resp.StatusCode
+	clientLogger.WithFields(fields).Debug("HTTP request")
+	return resp, nil
+}
@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"siody.home/om-like/internal/config"
+)
+
+func TestHTTPClientFromConfig(t *testing.T) {
+	cfg := config.NewMemory()
+	cfg.Set("api.test.hostname", "test")
+	cfg.Set("api.test.httpport", 8081)
+	cfg.Set("api.client.timeout", "3s")
+	cfg.Set("api.client.dialTimeout", "2s")
+	cfg.Set("api.test.client.timeout", "1s")
+	cfg.Set("api.test.client.maxIdleConnsPerHost", 4)
+
+	client, err := HTTPClientFromConfig(cfg, "api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.BaseURL != "http://test:8081" {
+		t.Errorf("unexpected base URL %s", client.BaseURL)
+	}
+	// The settings of the target override the ones of all targets, which
+	// override the defaults.
+	if client.Timeout != time.Second {
+		t.Errorf("expected the timeout of the target, got %s", client.Timeout)
+	}
+	if client.transport.MaxIdleConnsPerHost != 4 {
+		t.Errorf("expected 4 idle connections, got %d", client.transport.MaxIdleConnsPerHost)
+	}
+	if client.transport.TLSHandshakeTimeout != defaultClientTLSHandshakeTimeout {
+		t.Errorf("expected the default TLS handshake timeout, got %s", client.transport.TLSHandshakeTimeout)
+	}
+	if client.transport.TLSClientConfig != nil {
+		t.Error("expected no TLS without certificates")
+	}
+}
+
+func TestHTTPClientFromConfig_NoTarget(t *testing.T) {
+	if _, err := HTTPClientFromConfig(config.NewMemory(), "api.test"); err == nil {
+		t.Fatal("expected a client without hostname or endpoints to fail")
+	}
+}
+
+func TestHTTPClientCache(t *testing.T) {
+	cfg := config.NewMemory()
+	cfg.Set("api.test.hostname", "test")
+	cfg.Set("api.test.httpport", 8081)
+	cache := NewHTTPClientCache(cfg)
+	defer cache.Close()
+
+	first, err := cache.Get("api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cache.Get("api.test"); again != first {
+		t.Fatal("expected the cached client")
+	}
+	cfg.Set("api.test.httpport", 8082)
+	rebuilt, err := cache.Get("api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt == first || rebuilt.BaseURL != "http://test:8082" {
+		t.Fatalf("expected a client of the new port, got %s", rebuilt.BaseURL)
+	}
+}
+
+// whoami requests /whoami of the server with a new connection.
+func whoami(t *testing.T, client *HTTPClient) string {
+	t.Helper()
+	client.transport.CloseIdleConnections()
+	resp, err := client.Get(client.BaseURL + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d %q", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func TestHTTPClient_MutualTLS(t *testing.T) {
+	ca := newTestCA(t, "root")
+	_, write := tempDir(t)
+	cert, key := ca.issue(t, testCertificate{commonName: "before"})
+	cfg := config.NewMemory()
+	cfg.Set(configNameServerRootCertificatePath, write("ca.crt", ca.certPEM))
+	cfg.Set(configNameServerPublicCertificateFile, write("tls.crt", cert))
+	cfg.Set(configNameServerPrivateKeyFile, write("tls.key", key))
+	cfg.Set(configNameServerClientAuth, ClientAuthRequire)
+
+	// The server identifies clients with a separate certificate.
+	serverCert, serverKey := ca.issue(t, testCertificate{commonName: "server"})
+	l := mustListen(t)
+	p := NewServerParamsFromListeners(l)
+	p.SetTLSConfiguration(ca.certPEM, serverCert, serverKey)
+	p.SetClientAuth(tls.RequireAndVerifyClientCert)
+	p.AddHandleFunc(func(mux *http.ServeMux) {
+		mux.HandleFunc("/whoami", func(w http.ResponseWriter, req *http.Request) {
+			id, _ := IdentityFromContext(req.Context())
+			fmt.Fprint(w, id.Subject)
+		})
+	})
+	startServer(t, p)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	cfg.Set("api.test.hostname", "localhost")
+	cfg.Set("api.test.httpport", port)
+
+	client, err := HTTPClientFromConfig(cfg, "api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if subject := whoami(t, client); subject != "CN=before" {
+		t.Fatalf("expected the client certificate, got %s", subject)
+	}
+
+	// New connections present the rotated certificate.
+	cert, key = ca.issue(t, testCertificate{commonName: "after"})
+	write("tls.crt", cert)
+	write("tls.key", key)
+	deadline := time.Now().Add(5 * time.Second)
+	for whoami(t, client) != "CN=after" {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated client certificate was not presented")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestClientTLSConfig_ServerOnlyCertificate(t *testing.T) {
+	ca := newTestCA(t, "root")
+	_, write := tempDir(t)
+	cert, key := ca.issue(t, testCertificate{commonName: "server", extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	cfg := config.NewMemory()
+	cfg.Set(configNameServerRootCertificatePath, write("ca.crt", ca.certPEM))
+	cfg.Set(configNameServerPublicCertificateFile, write("tls.crt", cert))
+	cfg.Set(configNameServerPrivateKeyFile, write("tls.key", key))
+
+	cfg.Set(configNameServerClientAuth, ClientAuthRequire)
+	if _, _, err := clientTLSConfig(cfg); err == nil || !strings.Contains(err.Error(), "clientAuth") {
+		t.Fatalf("expected the missing clientAuth usage to fail, got %v", err)
+	}
+
+	// If the servers do not require client certificates, the clients go
+	// without.
+	cfg.Set(configNameServerClientAuth, ClientAuthRequest)
+	tlsConfig, certs, err := clientTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs != nil || tlsConfig.GetClientCertificate != nil {
+		t.Fatal("expected the clients not to present the server certificate")
+	}
+}
+
+func TestClientCertStore_ExpiryMetric(t *testing.T) {
+	if err := view.Register(certificateExpiryView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(certificateExpiryView)
+
+	ca := newTestCA(t, "root")
+	_, write := tempDir(t)
+	serverExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	clientExpiry := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+	serverCert, serverKey := ca.issue(t, testCertificate{commonName: "server", notAfter: serverExpiry})
+	clientCert, clientKey := ca.issue(t, testCertificate{commonName: "client", notAfter: clientExpiry})
+	rootFile := write("ca.crt", ca.certPEM)
+
+	server, err := newFileCertStore(rootFile, write("server.crt", serverCert), write("server.key", serverKey), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+	// The client certificate is labeled on its own, without replacing the
+	// expiry of the server certificate.
+	client, err := newClientCertStore(rootFile, write("client.crt", clientCert), write("client.key", clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	rows, err := view.RetrieveData(certificateExpiryView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiries := map[string]int64{}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == keyCertificate {
+				expiries[tag.Value] = int64(row.Data.(*view.LastValueData).Value)
+			}
+		}
+	}
+	if expiries["server"] != serverExpiry.Unix() || expiries["client"] != clientExpiry.Unix() {
+		t.Fatalf("expected the server expiry %d and the client expiry %d, got %v", serverExpiry.Unix(), clientExpiry.Unix(), expiries)
+	}
+}
@@ -0,0 +1,227 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/plugin/ocgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"siody.home/om-like/internal/telemetry"
+)
+
+// GRPCHandler binds gRPC services to the server.
+type GRPCHandler func(s *grpc.Server)
+
+// GRPCProxyHandler binds the JSON/REST gateway of a gRPC service to mux, which
+// forwards requests to the gRPC server at endpoint. It has the signature of
+// the Register<Service>HandlerFromEndpoint functions generated by
+// grpc-gateway.
+type GRPCProxyHandler func(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error
+
+// newGrpcServer returns a gRPC server with the health service and the services
+// of params, instrumented like the HTTP handlers. Calls with gatewayToken come
+// from the gateway, which forwards the identity of its caller.
+func newGrpcServer(params *ServerParams, gatewayToken string, opts ...grpc.ServerOption) *grpc.Server {
+	if params.enableMetrics {
+		opts = append(opts, grpc.StatsHandler(&ocgrpc.ServerHandler{}))
+	}
+	unary := []grpc.UnaryServerInterceptor{identityUnaryInterceptor(params.authorizer, gatewayToken)}
+	stream := []grpc.StreamServerInterceptor{identityStreamInterceptor(params.authorizer, gatewayToken)}
+	if params.enableRPCLogging {
+		unary = append([]grpc.UnaryServerInterceptor{loggingUnaryInterceptor(params.enableRPCPayloadLogging)}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{loggingStreamInterceptor}, stream...)
+	}
+	opts = append(opts,
+		grpc.UnaryInterceptor(chainUnaryInterceptors(unary)),
+		grpc.StreamInterceptor(chainStreamInterceptors(stream)),
+	)
+
+	s := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(s, telemetry.NewGrpcHealthCheck(params.handlersForHealthCheck))
+	for _, handlerFunc := range params.handlersForGrpc {
+		handlerFunc(s)
+	}
+	return s
+}
+
+// newGrpcProxy returns the JSON/REST gateway of the gRPC services with a proxy
+// handler, forwarding to the gRPC server at endpoint with opts. The identity of
+// the callers is forwarded with gatewayToken. Canceling ctx closes the
+// connections of the gateway.
+func newGrpcProxy(ctx context.Context, params *ServerParams, gatewayToken string, endpoint string, opts []grpc.DialOption) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{OrigName: true}),
+	)
+	opts = append(gatewayDialOptions(gatewayToken), opts...)
+	for _, handlerFunc := range params.handlersForGrpcProxy {
+		if err := handlerFunc(ctx, mux, endpoint, opts); err != nil {
+			return nil, err
+		}
+	}
+	return mux, nil
+}
+
+// localEndpoint returns the address to reach l from this host.
+func localEndpoint(l net.Listener) string {
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return l.Addr().String()
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// isGrpcRequest returns true for HTTP/2 requests with a gRPC content type.
+func isGrpcRequest(req *http.Request) bool {
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// sharedPortHandler serves gRPC requests with grpcServer and all other requests
+// with httpHandler, so that both share one listener. It counts the gRPC
+// requests in flight, as the HTTP server does not track them once h2c took
+// over their connection, and grpc.Server.GracefulStop does not support the
+// connections of ServeHTTP.
+type sharedPortHandler struct {
+	grpcServer  *grpc.Server
+	httpHandler http.Handler
+
+	m        sync.Mutex
+	inflight int
+	draining bool
+	idle     chan struct{}
+}
+
+func newSharedPortHandler(grpcServer *grpc.Server, httpHandler http.Handler) *sharedPortHandler {
+	return &sharedPortHandler{
+		grpcServer:  grpcServer,
+		httpHandler: httpHandler,
+	}
+}
+
+func (h *sharedPortHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isGrpcRequest(req) {
+		h.httpHandler.ServeHTTP(w, req)
+		return
+	}
+	if !h.begin() {
+		// Like a draining gRPC server, refuse new calls so that the clients
+		// retry on another server.
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.Unavailable)))
+		w.Header().Set("Grpc-Message", errShuttingDown.Error())
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	defer h.end()
+	h.grpcServer.ServeHTTP(w, req)
+}
+
+func (h *sharedPortHandler) begin() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.draining {
+		return false
+	}
+	h.inflight++
+	return true
+}
+
+func (h *sharedPortHandler) end() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.inflight--
+	if h.draining && h.inflight == 0 {
+		close(h.idle)
+	}
+}
+
+// drain refuses new gRPC calls and waits until the calls in flight completed
+// or ctx is done.
+func (h *sharedPortHandler) drain(ctx context.Context) error {
+	h.m.Lock()
+	if h.draining {
+		h.m.Unlock()
+		return nil
+	}
+	h.draining = true
+	if h.inflight == 0 {
+		h.m.Unlock()
+		return nil
+	}
+	h.idle = make(chan struct{})
+	h.m.Unlock()
+
+	select {
+	case <-h.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chainUnaryInterceptors returns an interceptor calling interceptors in order,
+// the first one being the outermost.
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// chainStreamInterceptors returns an interceptor calling interceptors in order,
+// the first one being the outermost.
+func chainStreamInterceptors(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(srv interface{}, stream grpc.ServerStream) error {
+				return interceptor(srv, stream, info, next)
+			}
+		}
+		return handler(srv, stream)
+	}
+}
+
+func loggingUnaryInterceptor(logPayloads bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		fields := logrus.Fields{
+			"method":   info.FullMethod,
+			"code":     status.Code(err).String(),
+			"duration": time.Since(start).String(),
+		}
+		if logPayloads {
+			fields["request"] = req
+			fields["response"] = resp
+		}
+		serverLogger.WithFields(fields).Debug("gRPC call")
+		return resp, err
+	}
+}
+
+func loggingStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, stream)
+	serverLogger.WithFields(logrus.Fields{
+		"method":   info.FullMethod,
+		"code":     status.Code(err).String(),
+		"duration": time.Since(start).String(),
+	}).Debug("gRPC stream")
+	return err
+}
@@ -0,0 +1,297 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func mustListen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// startServer starts a server of p, which is stopped at the end of the test.
+func startServer(t *testing.T, p *ServerParams) *Server {
+	t.Helper()
+	s := &Server{}
+	if err := s.Start(p); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func helloHandler(mux *http.ServeMux) {
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "hello %s", req.Proto)
+	})
+}
+
+func checkGrpcHealth(t *testing.T, addr string, opts ...grpc.DialOption) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, append(opts, grpc.WithBlock())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING, got %s", resp.Status)
+	}
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestIsGrpcRequest(t *testing.T) {
+	tests := []struct {
+		proto       int
+		contentType string
+		grpc        bool
+	}{
+		{2, "application/grpc", true},
+		{2, "application/grpc+proto", true},
+		{2, "application/json", false},
+		// gRPC requires HTTP/2, so HTTP/1 requests go to the HTTP handlers.
+		{1, "application/grpc", false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/", nil)
+		req.ProtoMajor = tt.proto
+		req.Header.Set("Content-Type", tt.contentType)
+		if got := isGrpcRequest(req); got != tt.grpc {
+			t.Errorf("HTTP/%d %s: expected %v, got %v", tt.proto, tt.contentType, tt.grpc, got)
+		}
+	}
+}
+
+func TestSharedPortHandler_RefusesCallsWhenDraining(t *testing.T) {
+	h := newSharedPortHandler(grpc.NewServer(), http.NotFoundHandler())
+	if err := h.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/grpc.health.v1.Health/Check", nil)
+	req.ProtoMajor = 2
+	req.Header.Set("Content-Type", "application/grpc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if code := w.Header().Get("Grpc-Status"); code != "14" {
+		t.Fatalf("expected the call to be refused with Unavailable, got status %q", code)
+	}
+}
+
+func TestServer_SharedPort(t *testing.T) {
+	l := mustListen(t)
+	p := NewServerParamsFromListeners(l)
+	p.AddHandleFunc(helloHandler)
+	startServer(t, p)
+
+	// gRPC clients speak HTTP/2 with prior knowledge on the HTTP port.
+	checkGrpcHealth(t, l.Addr().String(), grpc.WithInsecure())
+
+	status, body := getBody(t, http.DefaultClient, "http://"+l.Addr().String()+"/hello")
+	if status != http.StatusOK || body != "hello HTTP/1.1" {
+		t.Fatalf("unexpected HTTP response %d %q", status, body)
+	}
+
+	// An HTTP/1 request with a gRPC content type is not routed to gRPC.
+	resp, err := http.Post("http://"+l.Addr().String()+"/hello", "application/grpc", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the HTTP handler, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_SharedPortTLS(t *testing.T) {
+	ca := newTestCA(t, "root")
+	cert, key := ca.issue(t, testCertificate{commonName: "server"})
+	l := mustListen(t)
+	p := NewServerParamsFromListeners(l)
+	p.SetTLSConfiguration(ca.certPEM, cert, key)
+	p.AddHandleFunc(helloHandler)
+	startServer(t, p)
+
+	checkGrpcHealth(t, l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(ca.clientConfig(t))))
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   ca.clientConfig(t),
+		ForceAttemptHTTP2: true,
+	}}
+	status, body := getBody(t, client, "https://"+l.Addr().String()+"/hello")
+	if status != http.StatusOK || body != "hello HTTP/2.0" {
+		t.Fatalf("unexpected HTTP response %d %q", status, body)
+	}
+}
+
+func TestServer_SeparateGrpcPort(t *testing.T) {
+	httpL, grpcL := mustListen(t), mustListen(t)
+	p := NewServerParamsFromListeners(httpL)
+	p.grpcListener = grpcL
+	p.AddHandleFunc(helloHandler)
+	startServer(t, p)
+
+	checkGrpcHealth(t, grpcL.Addr().String(), grpc.WithInsecure())
+	if status, _ := getBody(t, http.DefaultClient, "http://"+httpL.Addr().String()+"/hello"); status != http.StatusOK {
+		t.Fatalf("unexpected HTTP status %d", status)
+	}
+
+	// The HTTP port does not serve gRPC.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, httpL.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err == nil {
+		t.Fatal("expected gRPC on the HTTP port to fail")
+	}
+}
+
+// registerWidgetService registers test.Widgets, whose Get method answers
+// SERVING for the widget "ok" and NotFound for the others.
+func registerWidgetService(s *grpc.Server) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Widgets",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Get",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &healthpb.HealthCheckRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					name := req.(*healthpb.HealthCheckRequest).Service
+					if name != "ok" {
+						return nil, status.Errorf(codes.NotFound, "no widget %s", name)
+					}
+					return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Widgets/Get"}, handler)
+			},
+		}},
+	}, struct{}{})
+}
+
+// widgetGateway binds GET /v1/widgets/{name} to test.Widgets/Get, like the
+// handlers generated by grpc-gateway.
+func widgetGateway(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error {
+	conn, err := grpc.DialContext(ctx, endpoint, opts...)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	pattern := runtime.MustPattern(runtime.NewPattern(1, []int{2, 0, 2, 1, 1, 0, 4, 1, 5, 2}, []string{"v1", "widgets", "name"}, ""))
+	mux.Handle(http.MethodGet, pattern, func(w http.ResponseWriter, req *http.Request, params map[string]string) {
+		_, outbound := runtime.MarshalerForRequest(mux, req)
+		ctx, err := runtime.AnnotateContext(req.Context(), mux, req)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, req, err)
+			return
+		}
+		resp := &healthpb.HealthCheckResponse{}
+		err = conn.Invoke(ctx, "/test.Widgets/Get", &healthpb.HealthCheckRequest{Service: params["name"]}, resp)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, req, err)
+			return
+		}
+		runtime.ForwardResponseMessage(ctx, mux, outbound, w, req, resp)
+	})
+	return nil
+}
+
+func TestGateway_RoutesAndErrors(t *testing.T) {
+	l := mustListen(t)
+	p := NewServerParamsFromListeners(l)
+	p.AddGrpcHandleFunc(registerWidgetService)
+	p.AddGrpcProxyHandleFunc(widgetGateway)
+	startServer(t, p)
+	base := "http://" + l.Addr().String()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		// body is the JSON body of the response, if it is checked.
+		body map[string]interface{}
+	}{
+		{name: "ok", method: http.MethodGet, path: "/v1/widgets/ok", status: http.StatusOK,
+			body: map[string]interface{}{"status": "SERVING"}},
+		// gRPC errors are mapped to HTTP statuses, with the gRPC code in the
+		// JSON body.
+		{name: "grpc error", method: http.MethodGet, path: "/v1/widgets/missing", status: http.StatusNotFound,
+			body: map[string]interface{}{"error": "no widget missing", "message": "no widget missing", "code": float64(codes.NotFound)}},
+		{name: "wrong verb", method: http.MethodPost, path: "/v1/widgets/ok", status: http.StatusMethodNotAllowed},
+		{name: "unknown path", method: http.MethodGet, path: "/v1/gadgets/ok", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, base+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected HTTP status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if tt.body == nil {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("expected a JSON body, got %s", ct)
+			}
+			var body map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, tt.body) {
+				t.Fatalf("expected the body %v, got %v", tt.body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	configNameServerClientAuth = "api.tls.clientAuth"
+	// configNameServerAdminClientAuth overrides api.tls.clientAuth on the
+	// admin port, such as for probes and scrapers without certificates.
+	configNameServerAdminClientAuth = "api.tls.adminClientAuth"
+
+	// ClientAuthNone does not ask clients for a certificate.
+	ClientAuthNone = "none"
+	// ClientAuthRequest asks clients for a certificate and verifies it if one
+	// is given.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire requires clients to present a verified certificate.
+	ClientAuthRequire = "require"
+
+	spiffeScheme = "spiffe"
+
+	// The JSON/REST gateway forwards the identity of its callers to the gRPC
+	// server in these metadata keys. The token proves that the metadata comes
+	// from the gateway of this process, not from a client.
+	gatewayTokenMetadata    = "x-om-gateway-token"
+	gatewayIdentityMetadata = "x-om-gateway-identity-bin"
+)
+
+// Identity is the verified identity of a client, taken from its TLS
+// certificate.
+type Identity struct {
+	// Subject is the distinguished name of the certificate.
+	Subject     string
+	DNSNames    []string
+	Emails      []string
+	IPAddresses []string
+	URIs        []string
+	// SPIFFEID is the spiffe:// URI SAN of the certificate, if any.
+	SPIFFEID string
+}
+
+// Authorizer decides whether the client with identity may call method, which
+// is the full gRPC method or the HTTP path. id is nil if the client did not
+// present a verified certificate. A returned error denies the call.
+type Authorizer func(ctx context.Context, id *Identity, method string) error
+
+type identityKey struct{}
+type authorizerKey struct{}
+
+// IdentityFromContext returns the verified identity of the client of a request,
+// if it presented a certificate.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok && id != nil
+}
+
+// Authorize checks with the Authorizer of the server whether the client of the
+// request may perform action. Handlers use it for checks finer than the method.
+// It returns nil if the server has no Authorizer.
+func Authorize(ctx context.Context, action string) error {
+	authorizer, ok := ctx.Value(authorizerKey{}).(Authorizer)
+	if !ok || authorizer == nil {
+		return nil
+	}
+	id, _ := IdentityFromContext(ctx)
+	return authorizer(ctx, id, action)
+}
+
+// clientAuthType returns the tls.ClientAuthType of a client auth mode.
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(mode) {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid client auth mode %q, expected %s, %s or %s", mode, ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+}
+
+// identityFromTLS returns the identity of the verified client certificate of
+// state, or nil.
+func identityFromTLS(state *tls.ConnectionState) *Identity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return newIdentity(state.VerifiedChains[0][0])
+}
+
+func newIdentity(cert *x509.Certificate) *Identity {
+	id := &Identity{
+		Subject:  cert.Subject.String(),
+		DNSNames: cert.DNSNames,
+		Emails:   cert.EmailAddresses,
+	}
+	for _, ip := range cert.IPAddresses {
+		id.IPAddresses = append(id.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+		if u.Scheme == spiffeScheme && id.SPIFFEID == "" {
+			id.SPIFFEID = u.String()
+		}
+	}
+	return id
+}
+
+// withIdentity adds the identity and the authorizer to ctx, and authorizes
+// method if authorizer is set.
+func withIdentity(ctx context.Context, id *Identity, authorizer Authorizer, method string) (context.Context, error) {
+	ctx = context.WithValue(ctx, identityKey{}, id)
+	if authorizer == nil {
+		return ctx, nil
+	}
+	ctx = context.WithValue(ctx, authorizerKey{}, authorizer)
+	return ctx, authorizer(ctx, id, method)
+}
+
+// identityHTTPHandler puts the identity of the client into the context of
+// requests and authorizes them.
+type identityHTTPHandler struct {
+	handler    http.Handler
+	authorizer Authorizer
+}
+
+func (h *identityHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, err := withIdentity(req.Context(), identityFromTLS(req.TLS), h.authorizer, req.URL.Path)
+	if err != nil {
+		serverLogger.WithError(err).WithField("path", req.URL.Path).Debug("request denied")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	h.handler.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// newGatewayToken returns a random token for the gateway of a server.
+func newGatewayToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "cannot generate the gateway token")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// gatewayContext replaces the gateway metadata of the outgoing context ctx
+// with token and the identity of the caller of the gateway, if any. Values
+// set by the caller, through Grpc-Metadata headers, are dropped.
+func gatewayContext(ctx context.Context, token string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(gatewayTokenMetadata, token)
+	delete(md, gatewayIdentityMetadata)
+	if id, ok := IdentityFromContext(ctx); ok {
+		data, err := json.Marshal(id)
+		if err != nil {
+			serverLogger.WithError(err).Warning("cannot forward the identity of the gateway caller")
+		} else {
+			md.Set(gatewayIdentityMetadata, string(data))
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// gatewayDialOptions returns the options of the gateway connections, which
+// forward the identity of the callers of the gateway.
+func gatewayDialOptions(token string) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(gatewayContext(ctx, token), method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(gatewayContext(ctx, token), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// gatewayIdentity returns the identity forwarded by the gateway, and true if
+// the call comes from the gateway. The gateway metadata is removed from the
+// returned context, so that handlers do not pass the token on.
+func gatewayIdentity(ctx context.Context, token string) (context.Context, *Identity, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || token == "" {
+		return ctx, nil, false
+	}
+	tokens := md.Get(gatewayTokenMetadata)
+	if len(tokens) != 1 || subtle.ConstantTimeCompare([]byte(tokens[0]), []byte(token)) != 1 {
+		return ctx, nil, false
+	}
+	md = md.Copy()
+	ids := md.Get(gatewayIdentityMetadata)
+	delete(md, gatewayTokenMetadata)
+	delete(md, gatewayIdentityMetadata)
+	ctx = metadata.NewIncomingContext(ctx, md)
+	if len(ids) != 1 {
+		return ctx, nil, true
+	}
+	id := &Identity{}
+	if err := json.Unmarshal([]byte(ids[0]), id); err != nil {
+		serverLogger.WithError(err).Warning("cannot read the identity forwarded by the gateway")
+		return ctx, nil, true
+	}
+	return ctx, id, true
+}
+
+// grpcIdentity returns the identity of the client of a call: the caller of the
+// gateway for calls through the gateway, else the peer certificate.
+func grpcIdentity(ctx context.Context, gatewayToken string) (context.Context, *Identity) {
+	if ctx, id, ok := gatewayIdentity(ctx, gatewayToken); ok {
+		return ctx, id
+	}
+	return ctx, peerIdentity(ctx)
+}
+
+func peerIdentity(ctx context.Context) *Identity {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return identityFromTLS(&tlsInfo.State)
+}
+
+func identityUnaryInterceptor(authorizer Authorizer, gatewayToken string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, id := grpcIdentity(ctx, gatewayToken)
+		ctx, err := withIdentity(ctx, id, authorizer, info.FullMethod)
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return handler(ctx, req)
+	}
+}
+
+func identityStreamInterceptor(authorizer Authorizer, gatewayToken string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, id := grpcIdentity(stream.Context(), gatewayToken)
+		ctx, err := withIdentity(ctx, id, authorizer, info.FullMethod)
+		if err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return handler(srv, &contextServerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// contextServerStream is a grpc.ServerStream with a different context.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,308 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func parseTestCertificate(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestNewIdentity(t *testing.T) {
+	ca := newTestCA(t, "root")
+	certPEM, _ := ca.issue(t, testCertificate{
+		commonName: "backend",
+		dnsNames:   []string{"backend.svc"},
+		uris:       []string{"https://example.com/backend", "spiffe://example.com/ns/om/sa/backend"},
+	})
+
+	id := newIdentity(parseTestCertificate(t, certPEM))
+	expected := &Identity{
+		Subject:     "CN=backend",
+		DNSNames:    []string{"localhost", "backend.svc"},
+		IPAddresses: []string{"127.0.0.1"},
+		URIs:        []string{"https://example.com/backend", "spiffe://example.com/ns/om/sa/backend"},
+		SPIFFEID:    "spiffe://example.com/ns/om/sa/backend",
+	}
+	if !reflect.DeepEqual(id, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, id)
+	}
+}
+
+func TestIdentityFromTLS_Unverified(t *testing.T) {
+	if id := identityFromTLS(nil); id != nil {
+		t.Fatalf("expected no identity without TLS, got %+v", id)
+	}
+	if id := identityFromTLS(&tls.ConnectionState{}); id != nil {
+		t.Fatalf("expected no identity without a verified certificate, got %+v", id)
+	}
+}
+
+func TestClientAuthType(t *testing.T) {
+	tests := map[string]tls.ClientAuthType{
+		"":        tls.NoClientCert,
+		"none":    tls.NoClientCert,
+		"request": tls.VerifyClientCertIfGiven,
+		"Require": tls.RequireAndVerifyClientCert,
+	}
+	for mode, expected := range tests {
+		got, err := clientAuthType(mode)
+		if err != nil || got != expected {
+			t.Errorf("%q: expected %v, got %v, %v", mode, expected, got, err)
+		}
+	}
+	if _, err := clientAuthType("optional"); err == nil {
+		t.Error("expected an invalid mode to fail")
+	}
+}
+
+// adminOnly allows the clients with the common name admin.
+func adminOnly(ctx context.Context, id *Identity, method string) error {
+	if id == nil {
+		return errors.New("unauthenticated")
+	}
+	if id.Subject != "CN=admin" {
+		return fmt.Errorf("%s may not call %s", id.Subject, method)
+	}
+	return nil
+}
+
+// startAuthorizedServer starts a TLS server on a shared port requesting client
+// certificates and authorizing them with adminOnly. Its /whoami handler
+// returns the subject of the identity of the client.
+func startAuthorizedServer(t *testing.T, ca *testCA) string {
+	t.Helper()
+	cert, key := ca.issue(t, testCertificate{commonName: "server"})
+	l := mustListen(t)
+	p := NewServerParamsFromListeners(l)
+	p.SetTLSConfiguration(ca.certPEM, cert, key)
+	p.SetClientAuth(tls.VerifyClientCertIfGiven)
+	p.SetAuthorizer(adminOnly)
+	p.AddHandleFunc(func(mux *http.ServeMux) {
+		mux.HandleFunc("/whoami", func(w http.ResponseWriter, req *http.Request) {
+			id, _ := IdentityFromContext(req.Context())
+			if err := Authorize(req.Context(), "whoami"); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, id.Subject)
+		})
+	})
+	startServer(t, p)
+	return l.Addr().String()
+}
+
+func TestAuthorizer(t *testing.T) {
+	ca := newTestCA(t, "root")
+	addr := startAuthorizedServer(t, ca)
+	adminCert, adminKey := ca.issue(t, testCertificate{commonName: "admin"})
+	userCert, userKey := ca.issue(t, testCertificate{commonName: "user"})
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+		status int
+		code   codes.Code
+	}{
+		{name: "allowed", config: ca.clientConfig(t, adminCert, adminKey), status: http.StatusOK, code: codes.OK},
+		{name: "denied", config: ca.clientConfig(t, userCert, userKey), status: http.StatusForbidden, code: codes.PermissionDenied},
+		{name: "unauthenticated", config: ca.clientConfig(t), status: http.StatusForbidden, code: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.config}}
+			code, body := getBody(t, client, "https://"+addr+"/whoami")
+			if code != tt.status {
+				t.Fatalf("expected HTTP status %d, got %d %q", tt.status, code, body)
+			}
+			if code == http.StatusOK && body != "CN=admin" {
+				t.Fatalf("expected the admin identity, got %q", body)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(tt.config)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("expected gRPC code %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+// healthGateway binds GET /v1/health to the Check method of the health service,
+// like the handlers generated by grpc-gateway.
+func healthGateway(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error {
+	conn, err := grpc.DialContext(ctx, endpoint, opts...)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	client := healthpb.NewHealthClient(conn)
+	pattern := runtime.MustPattern(runtime.NewPattern(1, []int{2, 0, 2, 1}, []string{"v1", "health"}, ""))
+	mux.Handle(http.MethodGet, pattern, func(w http.ResponseWriter, req *http.Request, _ map[string]string) {
+		_, outbound := runtime.MarshalerForRequest(mux, req)
+		ctx, err := runtime.AnnotateContext(req.Context(), mux, req)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, req, err)
+			return
+		}
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, req, err)
+			return
+		}
+		runtime.ForwardResponseMessage(ctx, mux, outbound, w, req, resp)
+	})
+	return nil
+}
+
+func TestGateway_ForwardsCallerIdentity(t *testing.T) {
+	ca := newTestCA(t, "root")
+	cert, key := ca.issue(t, testCertificate{commonName: "server"})
+	l := mustListen(t)
+	p := NewServerParamsFromListeners(l)
+	p.SetTLSConfiguration(ca.certPEM, cert, key)
+	p.SetClientAuth(tls.RequireAndVerifyClientCert)
+	// The service trusts itself and the admin with the health service, and
+	// everyone with the HTTP paths.
+	p.SetAuthorizer(func(ctx context.Context, id *Identity, method string) error {
+		if method != "/grpc.health.v1.Health/Check" {
+			return nil
+		}
+		if id == nil || (id.Subject != "CN=server" && id.Subject != "CN=admin") {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	p.AddGrpcProxyHandleFunc(healthGateway)
+	startServer(t, p)
+
+	adminCert, adminKey := ca.issue(t, testCertificate{commonName: "admin"})
+	userCert, userKey := ca.issue(t, testCertificate{commonName: "user"})
+	tests := []struct {
+		name   string
+		config *tls.Config
+		header string
+		status int
+	}{
+		{name: "allowed", config: ca.clientConfig(t, adminCert, adminKey), status: http.StatusOK},
+		{name: "denied", config: ca.clientConfig(t, userCert, userKey), status: http.StatusForbidden},
+		// The identity metadata cannot be set by the caller.
+		{name: "forged", config: ca.clientConfig(t, userCert, userKey), header: `{"Subject":"CN=admin"}`, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://"+l.Addr().String()+"/v1/health", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set("Grpc-Metadata-"+gatewayIdentityMetadata, base64.StdEncoding.EncodeToString([]byte(tt.header)))
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.config}}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected HTTP status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestGatewayIdentity_Token(t *testing.T) {
+	forwarded := `{"Subject":"CN=admin"}`
+	tests := []struct {
+		name    string
+		md      metadata.MD
+		gateway bool
+		id      *Identity
+	}{
+		{name: "no metadata", md: metadata.MD{}},
+		{name: "wrong token", md: metadata.Pairs(gatewayTokenMetadata, "guess", gatewayIdentityMetadata, forwarded)},
+		{name: "two tokens", md: metadata.Pairs(gatewayTokenMetadata, "token", gatewayTokenMetadata, "guess")},
+		{name: "unauthenticated caller", md: metadata.Pairs(gatewayTokenMetadata, "token"), gateway: true},
+		{name: "caller", md: metadata.Pairs(gatewayTokenMetadata, "token", gatewayIdentityMetadata, forwarded), gateway: true, id: &Identity{Subject: "CN=admin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, id, ok := gatewayIdentity(metadata.NewIncomingContext(context.Background(), tt.md), "token")
+			if ok != tt.gateway || !reflect.DeepEqual(id, tt.id) {
+				t.Fatalf("expected %+v, %v, got %+v, %v", tt.id, tt.gateway, id, ok)
+			}
+			if md, _ := metadata.FromIncomingContext(ctx); ok && len(md.Get(gatewayTokenMetadata)) > 0 {
+				t.Fatal("expected the gateway token to be removed")
+			}
+		})
+	}
+}
+
+func TestGateway_ServerOnlyCertificate(t *testing.T) {
+	ca := newTestCA(t, "root")
+	cert, key := ca.issue(t, testCertificate{commonName: "server", extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	newParams := func(clientAuth tls.ClientAuthType) (*ServerParams, string) {
+		l := mustListen(t)
+		p := NewServerParamsFromListeners(l)
+		p.SetTLSConfiguration(ca.certPEM, cert, key)
+		p.SetClientAuth(clientAuth)
+		p.AddGrpcHandleFunc(registerWidgetService)
+		p.AddGrpcProxyHandleFunc(widgetGateway)
+		return p, l.Addr().String()
+	}
+
+	// The gateway would fail every handshake with the server certificate, so
+	// the server does not start.
+	p, _ := newParams(tls.RequireAndVerifyClientCert)
+	s := &Server{}
+	err := s.Start(p)
+	if err == nil {
+		s.Stop()
+		t.Fatal("expected the server to refuse a gateway certificate without clientAuth")
+	}
+	if !strings.Contains(err.Error(), "clientAuth") {
+		t.Fatalf("expected the missing clientAuth usage in the error, got %v", err)
+	}
+
+	// If client certificates are optional, the gateway presents none.
+	p, addr := newParams(tls.VerifyClientCertIfGiven)
+	startServer(t, p)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t)}}
+	if code, body := getBody(t, client, "https://"+addr+"/v1/widgets/ok"); code != http.StatusOK {
+		t.Fatalf("expected the gateway to reach the gRPC server, got %d %q", code, body)
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"net"
 	"net/http"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+
 	"siody.home/om-like/internal/telemetry"
 )
 
@@ -12,22 +16,67 @@ type insecureServer struct {
 	httpListener net.Listener
 	httpMux      *http.ServeMux
 	httpServer   *http.Server
+
+	grpcListener net.Listener
+	grpcServer   *grpc.Server
+	proxyCancel  context.CancelFunc
+	// shared serves gRPC on the HTTP port, if there is no gRPC listener.
+	shared *sharedPortHandler
+
+	adminServer *http.Server
 }
 
 func (s *insecureServer) start(params *ServerParams) error {
 	s.httpMux = params.ServeMux
 
+	gatewayToken, err := newGatewayToken()
+	if err != nil {
+		return err
+	}
+
 	// Configure the HTTP proxy server.
 	// Bind gRPC handlers
+	s.grpcServer = newGrpcServer(params, gatewayToken)
 
 	for _, handlerFunc := range params.handlerForHTTP {
 		handlerFunc(s.httpMux)
 	}
 
-	s.httpMux.Handle(telemetry.HealthCheckEndpoint, telemetry.NewHealthCheck(params.handlersForHealthCheck))
+	// Bind the JSON/REST gateway to the gRPC services.
+	if len(params.handlersForGrpcProxy) > 0 {
+		var ctx context.Context
+		ctx, s.proxyCancel = context.WithCancel(context.Background())
+		grpcL := s.grpcListener
+		if grpcL == nil {
+			grpcL = s.httpListener
+		}
+		proxy, err := newGrpcProxy(ctx, params, gatewayToken, localEndpoint(grpcL), []grpc.DialOption{grpc.WithInsecure()})
+		if err != nil {
+			s.proxyCancel()
+			return err
+		}
+		s.httpMux.Handle("/", proxy)
+	}
+
+	params.TelemetryMux().Handle(telemetry.HealthCheckEndpoint, telemetry.NewHealthCheck(params.handlersForHealthCheck))
+	handler := instrumentHTTPHandler(s.httpMux, params)
+	if s.grpcListener == nil {
+		// Without TLS, gRPC clients speak HTTP/2 with prior knowledge (h2c).
+		s.shared = newSharedPortHandler(s.grpcServer, handler)
+		handler = h2c.NewHandler(s.shared, &http2.Server{})
+	} else {
+		go func() {
+			serverLogger.Infof("Serving gRPC: %s", s.grpcListener.Addr().String())
+			gErr := s.grpcServer.Serve(s.grpcListener)
+			if gErr != nil && gErr != grpc.ErrServerStopped {
+				serverLogger.Debugf("error serving gRPC: %s", gErr)
+			}
+		}()
+	}
+
 	s.httpServer = &http.Server{
 		Addr:    s.httpListener.Addr().String(),
-		Handler: instrumentHTTPHandler(s.httpMux, params),
+		Handler: handler,
 	}
 	go func() {
 		serverLogger.Infof("Serving HTTP: %s", s.httpListener.Addr().String())
@@ -37,17 +86,26 @@ func (s *insecureServer) start(params *ServerParams) error {
 		}
 	}()
 
+	s.adminServer = startAdminServer(params, nil)
+
 	return nil
 }
 
-func (s *insecureServer) stop() error {
+func (s *insecureServer) stop(ctx context.Context) error {
 	// the servers also close their respective listeners.
-	err := s.httpServer.Shutdown(context.Background())
+	err := shutdownServers(ctx, s.httpServer, s.grpcServer, s.shared)
+	if s.proxyCancel != nil {
+		s.proxyCancel()
+	}
+	if aErr := closeAdminServer(s.adminServer); err == nil {
+		err = aErr
+	}
 	return err
 }
 
-func newInsecureServer(httpL net.Listener) *insecureServer {
+func newInsecureServer(httpL, grpcL net.Listener) *insecureServer {
 	return &insecureServer{
 		httpListener: httpL,
+		grpcListener: grpcL,
 	}
 }
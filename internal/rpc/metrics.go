@@ -0,0 +1,16 @@
+package rpc
+
+import (
+	"go.opencensus.io/stats/view"
+)
+
+// OpenCensusViews are the views of the server and client metrics, to be registered
+// with Bindings.RegisterViews.
+var OpenCensusViews = []*view.View{
+	certificateExpiryView,
+	clientAttemptsView,
+	retryBudgetExhaustedView,
+	breakerStateView,
+	breakerRejectionsView,
+	healthyEndpointsView,
+}
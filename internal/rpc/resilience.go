@@ -0,0 +1,492 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
+	"siody.home/om-like/internal/config"
+)
+
+const (
+	defaultRetryMaxAttempts     = 3
+	defaultRetryInitialBackoff  = 100 * time.Millisecond
+	defaultRetryMaxBackoff      = 2 * time.Second
+	defaultRetryMultiplier      = 2.0
+	defaultRetryJitter          = 0.2
+	defaultRetryBudgetRatio     = 0.1
+	defaultRetryBudgetPerSecond = 10
+	defaultHedgeMaxRequests     = 2
+	defaultBreakerThreshold     = 5
+	defaultBreakerOpenTimeout   = 30 * time.Second
+
+	attemptFirst = "first"
+	attemptRetry = "retry"
+	attemptHedge = "hedge"
+
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+var (
+	// ErrCircuitOpen is returned for requests to a host whose circuit breaker
+	// is open.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	resilienceConfigFields = clientSettingFields(
+		config.Field{Key: "retry.maxAttempts", Type: config.TypeInt, Range: &config.Range{Min: 1, Max: 100}},
+		config.Field{Key: "retry.initialBackoff", Type: config.TypeDuration},
+		config.Field{Key: "retry.maxBackoff", Type: config.TypeDuration},
+		config.Field{Key: "retry.multiplier", Type: config.TypeFloat, Range: &config.Range{Min: 1, Max: 10}},
+		config.Field{Key: "retry.jitter", Type: config.TypeFloat, Range: &config.Range{Min: 0, Max: 1}},
+		config.Field{Key: "retry.budgetRatio", Type: config.TypeFloat, Range: &config.Range{Min: 0, Max: 1}},
+		config.Field{Key: "retry.budgetPerSecond", Type: config.TypeFloat, Range: &config.Range{Min: 0, Max: math.MaxInt32}},
+		config.Field{Key: "hedge.delay", Type: config.TypeDuration},
+		config.Field{Key: "hedge.maxRequests", Type: config.TypeInt, Range: &config.Range{Min: 1, Max: 10}},
+		config.Field{Key: "breaker.failureThreshold", Type: config.TypeInt, Range: &config.Range{Min: 0, Max: math.MaxInt32}},
+		config.Field{Key: "breaker.openTimeout", Type: config.TypeDuration},
+	)
+
+	keyTarget  = tag.MustNewKey("target")
+	keyHost    = tag.MustNewKey("host")
+	keyAttempt = tag.MustNewKey("attempt")
+
+	mClientAttempts       = stats.Int64("rpc/client_attempts", "Number of attempts of client requests", stats.UnitDimensionless)
+	mRetryBudgetExhausted = stats.Int64("rpc/client_retry_budget_exhausted", "Number of retries skipped because the retry budget was exhausted", stats.UnitDimensionless)
+	mBreakerState         = stats.Int64("rpc/client_breaker_state", "State of the circuit breaker of a host, 0 closed, 1 open, 2 half-open", stats.UnitDimensionless)
+	mBreakerRejections    = stats.Int64("rpc/client_breaker_rejections", "Number of requests rejected by an open circuit breaker", stats.UnitDimensionless)
+
+	clientAttemptsView = &view.View{
+		Measure:     mClientAttempts,
+		Name:        "rpc/client_attempts",
+		Description: "Number of attempts of client requests, by first attempt, retry and hedge",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget, keyAttempt},
+	}
+	retryBudgetExhaustedView = &view.View{
+		Measure:     mRetryBudgetExhausted,
+		Name:        "rpc/client_retry_budget_exhausted",
+		Description: "Number of retries skipped because the retry budget was exhausted",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget},
+	}
+	breakerStateView = &view.View{
+		Measure:     mBreakerState,
+		Name:        "rpc/client_breaker_state",
+		Description: "State of the circuit breaker of a host, 0 closed, 1 open, 2 half-open",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyTarget, keyHost},
+	}
+	breakerRejectionsView = &view.View{
+		Measure:     mBreakerRejections,
+		Name:        "rpc/client_breaker_rejections",
+		Description: "Number of requests rejected by an open circuit breaker",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget, keyHost},
+	}
+)
+
+func recordWithTags(mutators []tag.Mutator, ms ...stats.Measurement) {
+	if err := stats.RecordWithTags(context.Background(), mutators, ms...); err != nil {
+		clientLogger.WithError(err).Warning("cannot record client metrics")
+	}
+}
+
+// isIdempotent returns true for the methods which can be sent more than once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isRetryable returns true if an attempt which ended with resp and err may
+// succeed when it is retried.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return err != ErrCircuitOpen && err != context.Canceled && err != context.DeadlineExceeded
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// canResend returns true if the body of req can be sent again.
+func canResend(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// cloneRequest returns a copy of req with ctx and a fresh body.
+func cloneRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	clone := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+func discard(resp *http.Response) {
+	if resp != nil && resp.Body != nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// retryBudget limits retries to a ratio of the requests, plus a minimum
+// rate, so that retries cannot multiply the load on a failing target.
+type retryBudget struct {
+	ratio float64
+	min   *rate.Limiter
+
+	m      sync.Mutex
+	tokens float64
+}
+
+func newRetryBudget(ratio, perSecond float64) *retryBudget {
+	return &retryBudget{
+		ratio: ratio,
+		min:   rate.NewLimiter(rate.Limit(perSecond), int(math.Max(1, perSecond))),
+	}
+}
+
+// deposit is called for every request.
+func (b *retryBudget) deposit() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	// Cap the savings, so that a long healthy period does not allow a burst
+	// of retries.
+	b.tokens = math.Min(b.tokens+b.ratio, 100*b.ratio+1)
+}
+
+// withdraw returns true if a retry is allowed.
+func (b *retryBudget) withdraw() bool {
+	b.m.Lock()
+	if b.tokens >= 1 {
+		b.tokens--
+		b.m.Unlock()
+		return true
+	}
+	b.m.Unlock()
+	return b.min.Allow()
+}
+
+// retryTransport retries failed requests with exponential backoff and jitter.
+type retryTransport struct {
+	base           http.RoundTripper
+	target         string
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	multiplier     float64
+	jitter         float64
+	budget         *retryBudget
+}
+
+func (t *retryTransport) backoff(retry int) time.Duration {
+	d := float64(t.initialBackoff) * math.Pow(t.multiplier, float64(retry-1))
+	d = math.Min(d, float64(t.maxBackoff))
+	d *= 1 + t.jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.deposit()
+	recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, t.target), tag.Upsert(keyAttempt, attemptFirst)}, mClientAttempts.M(1))
+	resp, err := t.base.RoundTrip(req)
+	if t.maxAttempts <= 1 || !isIdempotent(req) || !canResend(req) {
+		return resp, err
+	}
+
+	for attempt := 2; attempt <= t.maxAttempts && isRetryable(resp, err); attempt++ {
+		if !t.budget.withdraw() {
+			recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, t.target)}, mRetryBudgetExhausted.M(1))
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			discard(resp)
+			return nil, req.Context().Err()
+		case <-time.After(t.backoff(attempt - 1)):
+		}
+
+		retry, cloneErr := cloneRequest(req.Context(), req)
+		if cloneErr != nil {
+			break
+		}
+		clientLogger.WithFields(logrus.Fields{
+			"target":  t.target,
+			"url":     req.URL.String(),
+			"attempt": attempt,
+		}).Debug("retrying request")
+		discard(resp)
+		recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, t.target), tag.Upsert(keyAttempt, attemptRetry)}, mClientAttempts.M(1))
+		resp, err = t.base.RoundTrip(retry)
+	}
+	return resp, err
+}
+
+// hedgeTransport sends another copy of an idempotent request when no response
+// arrived within delay, and returns the first response.
+type hedgeTransport struct {
+	base        http.RoundTripper
+	target      string
+	delay       time.Duration
+	maxRequests int
+}
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	attempt int
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.delay <= 0 || t.maxRequests <= 1 || !isIdempotent(req) || !canResend(req) {
+		return t.base.RoundTrip(req)
+	}
+	results := make(chan hedgeResult, t.maxRequests)
+	var cancels []context.CancelFunc
+	send := func() bool {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt, err := cloneRequest(ctx, req)
+		if err != nil {
+			cancel()
+			return false
+		}
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := t.base.RoundTrip(attempt)
+			results <- hedgeResult{resp: resp, err: err, attempt: i}
+		}()
+		return true
+	}
+
+	if !send() {
+		return t.base.RoundTrip(req)
+	}
+	// Every attempt sends a copy of the body from GetBody, so the body of req
+	// is never sent.
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	pending := 1
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if len(cancels) < t.maxRequests && send() {
+				pending++
+				recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, t.target), tag.Upsert(keyAttempt, attemptHedge)}, mClientAttempts.M(1))
+				timer.Reset(t.delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// The losers are canceled right away, and their responses
+				// discarded when they return.
+				for i, cancel := range cancels {
+					if i != r.attempt {
+						cancel()
+					}
+				}
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						discard((<-results).resp)
+					}
+				}(pending)
+				r.resp.Body = &cancelBody{ReadCloser: r.resp.Body, cancel: cancels[r.attempt]}
+				return r.resp, nil
+			}
+			cancels[r.attempt]()
+			last = r
+		}
+	}
+	return nil, last.err
+}
+
+// cancelBody cancels the context of its request when it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// breakerTransport is a circuit breaker for each host. After threshold
+// consecutive failures, the requests to the host fail with ErrCircuitOpen for
+// openTimeout. Then a single request is let through, and its result closes
+// or reopens the circuit.
+type breakerTransport struct {
+	base        http.RoundTripper
+	target      string
+	threshold   int
+	openTimeout time.Duration
+
+	m        sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.threshold <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	host := req.URL.Host
+	if !t.allow(host) {
+		recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, t.target), tag.Upsert(keyHost, host)}, mBreakerRejections.M(1))
+		return nil, ErrCircuitOpen
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// The caller gave up, or another hedged attempt won: the request
+		// says nothing about the host.
+		t.abandon(host)
+		return resp, err
+	}
+	t.report(host, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
+
+func (t *breakerTransport) allow(host string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < t.openTimeout {
+			return false
+		}
+		t.setState(host, b, breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (t *breakerTransport) report(host string, success bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		if success {
+			return
+		}
+		b = &breaker{}
+		t.breakers[host] = b
+	}
+	b.probing = false
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			t.setState(host, b, breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= t.threshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			t.setState(host, b, breakerOpen)
+		}
+	}
+}
+
+// abandon ends a request to host without a result, so that the breaker lets
+// another probe through.
+func (t *breakerTransport) abandon(host string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if b, ok := t.breakers[host]; ok {
+		b.probing = false
+	}
+}
+
+// setState changes the state of b. t.m must be held.
+func (t *breakerTransport) setState(host string, b *breaker, state int) {
+	b.state = state
+	recordWithTags([]tag.Mutator{tag.Upsert(keyTarget, t.target), tag.Upsert(keyHost, host)}, mBreakerState.M(int64(state)))
+	fields := logrus.Fields{"target": t.target, "host": host}
+	switch state {
+	case breakerOpen:
+		clientLogger.WithFields(fields).Warning("circuit breaker opened")
+	case breakerClosed:
+		clientLogger.WithFields(fields).Info("circuit breaker closed")
+	}
+}
+
+// resilientTransport wraps base with the circuit breaker, hedging and retry
+// policies configured for the target at prefix. If lb is set, it picks the
+// endpoint of each attempt, so that the breakers are per endpoint.
+func resilientTransport(cfg config.View, prefix string, base http.RoundTripper, lb *balancer) http.RoundTripper {
+	rt := &breakerTransport{
+		base:        base,
+		target:      prefix,
+		threshold:   clientInt(cfg, prefix, "breaker.failureThreshold", defaultBreakerThreshold),
+		openTimeout: clientDuration(cfg, prefix, "breaker.openTimeout", defaultBreakerOpenTimeout),
+		breakers:    make(map[string]*breaker),
+	}
+	var balanced http.RoundTripper = rt
+	if lb != nil {
+		lb.base = rt
+		balanced = lb
+	}
+	hedge := &hedgeTransport{
+		base:        balanced,
+		target:      prefix,
+		delay:       clientDuration(cfg, prefix, "hedge.delay", 0),
+		maxRequests: clientInt(cfg, prefix, "hedge.maxRequests", defaultHedgeMaxRequests),
+	}
+	return &retryTransport{
+		base:           hedge,
+		target:         prefix,
+		maxAttempts:    clientInt(cfg, prefix, "retry.maxAttempts", defaultRetryMaxAttempts),
+		initialBackoff: clientDuration(cfg, prefix, "retry.initialBackoff", defaultRetryInitialBackoff),
+		maxBackoff:     clientDuration(cfg, prefix, "retry.maxBackoff", defaultRetryMaxBackoff),
+		multiplier:     clientFloat(cfg, prefix, "retry.multiplier", defaultRetryMultiplier),
+		jitter:         clientFloat(cfg, prefix, "retry.jitter", defaultRetryJitter),
+		budget: newRetryBudget(
+			clientFloat(cfg, prefix, "retry.budgetRatio", defaultRetryBudgetRatio),
+			clientFloat(cfg, prefix, "retry.budgetPerSecond", defaultRetryBudgetPerSecond),
+		),
+	}
+}
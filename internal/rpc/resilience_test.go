@@ -0,0 +1,165 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func okResponse() *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed int32
+}
+
+func (c *closeRecorder) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func TestHedge_CancelsLosers(t *testing.T) {
+	var calls int32
+	loserCanceled := make(chan struct{})
+	hedge := &hedgeTransport{
+		target:      "api.test",
+		delay:       10 * time.Millisecond,
+		maxRequests: 2,
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				// The first attempt hangs until it is canceled.
+				<-req.Context().Done()
+				close(loserCanceled)
+				return nil, req.Context().Err()
+			}
+			return okResponse(), nil
+		}),
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://test/", nil)
+	resp, err := hedge.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The loser is canceled before the winner is read.
+	select {
+	case <-loserCanceled:
+	case <-time.After(time.Second):
+		t.Fatal("the losing attempt was not canceled")
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	resp.Body.Close()
+}
+
+func TestHedge_ClosesOriginalBody(t *testing.T) {
+	hedge := &hedgeTransport{
+		target:      "api.test",
+		delay:       time.Millisecond,
+		maxRequests: 2,
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			_, _ = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			return okResponse(), nil
+		}),
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, "http://test/", strings.NewReader("payload"))
+	body := &closeRecorder{Reader: req.Body}
+	req.Body = body
+	resp, err := hedge.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt32(&body.closed) == 0 {
+		t.Fatal("expected the body of the request to be closed")
+	}
+}
+
+func TestBreaker_IgnoresCanceledRequests(t *testing.T) {
+	failures := 0
+	breaker := &breakerTransport{
+		target:      "api.test",
+		threshold:   1,
+		openTimeout: time.Minute,
+		breakers:    make(map[string]*breaker),
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+			failures++
+			return nil, errors.New("connection refused")
+		}),
+	}
+
+	// Requests canceled by the caller do not count as failures of the host.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://test/", nil)
+		if _, err := breaker.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+			t.Fatalf("expected the request to be canceled, got %v", err)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://test/", nil)
+	if _, err := breaker.RoundTrip(req); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("expected the request to reach the host, got %v", err)
+	}
+	if _, err := breaker.RoundTrip(req); err != ErrCircuitOpen {
+		t.Fatalf("expected the failure to open the circuit, got %v", err)
+	}
+	if failures != 1 {
+		t.Fatalf("expected 1 request to the host, got %d", failures)
+	}
+}
+
+func TestBreaker_CanceledProbe(t *testing.T) {
+	breaker := &breakerTransport{
+		target:      "api.test",
+		threshold:   1,
+		openTimeout: time.Millisecond,
+		breakers:    make(map[string]*breaker),
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+			return okResponse(), nil
+		}),
+	}
+	breaker.report("test", false)
+	time.Sleep(2 * time.Millisecond)
+
+	// A canceled probe lets the next request probe the host.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://test/", nil)
+	if _, err := breaker.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+		t.Fatalf("expected the probe to be canceled, got %v", err)
+	}
+	resp, err := breaker.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected a new probe, got %v", err)
+	}
+	resp.Body.Close()
+	if state := breaker.breakers["test"].state; state != breakerClosed {
+		t.Fatalf("expected the circuit to close, got state %d", state)
+	}
+}
@@ -16,11 +16,14 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -42,8 +45,30 @@ var (
 		"app":       "openmatch",
 		"component": "server",
 	})
+
+	// ConfigFields describes the configuration keys read by this package.
+	ConfigFields = concatFields([]config.Field{
+		{Key: "api.*.httpport", Type: config.TypeInt, Range: &config.Range{Min: 0, Max: 65535}},
+		{Key: "api.*.grpcport", Type: config.TypeInt, Range: &config.Range{Min: 0, Max: 65535}},
+		{Key: "api.*.adminport", Type: config.TypeInt, Range: &config.Range{Min: 0, Max: 65535}},
+		{Key: configNameServerPublicCertificateFile, Type: config.TypeString},
+		{Key: configNameServerPrivateKeyFile, Type: config.TypeString},
+		{Key: configNameServerRootCertificatePath, Type: config.TypeString},
+		{Key: configNameServerCertificateExpiryWarning, Type: config.TypeDuration},
+		{Key: configNameServerClientAuth, Type: config.TypeString, Values: []string{ClientAuthNone, ClientAuthRequest, ClientAuthRequire}},
+		{Key: configNameServerAdminClientAuth, Type: config.TypeString, Values: []string{ClientAuthNone, ClientAuthRequest, ClientAuthRequire}},
+		{Key: ConfigNameEnableRPCLogging, Type: config.TypeBool},
+	}, tlsPolicyConfigFields, clientConfigFields, resilienceConfigFields, balancerConfigFields, shutdownConfigFields)
 )
 
+func concatFields(lists ...[]config.Field) []config.Field {
+	var fields []config.Field
+	for _, l := range lists {
+		fields = append(fields, l...)
+	}
+	return fields
+}
+
 // HTTPHandler logic http handler
 type HTTPHandler func(mux *http.ServeMux)
 
@@ -52,11 +77,22 @@ type ServerParams struct {
 	// ServeMux is the router for the HTTP server. You can use this to serve pages in addition to the HTTP proxy.
 	// Do NOT register "/" handler because it's reserved for the proxy.
 	ServeMux *http.ServeMux
+	// AdminMux is the router of the admin port, if one is configured. The
+	// telemetry, health and debug endpoints are served there, instead of on
+	// ServeMux.
+	AdminMux *http.ServeMux
 
 	handlerForHTTP         []HTTPHandler
+	handlersForGrpc        []GRPCHandler
+	handlersForGrpcProxy   []GRPCProxyHandler
 	handlersForHealthCheck []func(context.Context) error
 
 	httpListener net.Listener
+	// grpcListener serves gRPC on its own port. If it is nil, gRPC is served
+	// on httpListener.
+	grpcListener net.Listener
+	// adminListener serves AdminMux, if an admin port is configured.
+	adminListener net.Listener
 
 	// Root CA public certificate in PEM format.
 	rootCaPublicCertificateFileData []byte
@@ -65,6 +101,25 @@ type ServerParams struct {
 	publicCertificateFileData []byte
 	// Private key in PEM format.
 	privateKeyFileData []byte
+	// The files of the certificates and the key, if they were read from
+	// files. They are watched, and reloaded when they change.
+	rootCaPublicCertificateFile string
+	publicCertificateFile       string
+	privateKeyFile              string
+	// certificateExpiryWarning is how long before the certificate expires the
+	// health check starts warning.
+	certificateExpiryWarning time.Duration
+	// tlsPolicy are the protocol settings of TLS mode.
+	tlsPolicy *tlsPolicy
+	// clientAuth is the policy for client certificates in TLS mode.
+	clientAuth tls.ClientAuthType
+	// adminClientAuth is the policy for client certificates of the admin
+	// port, if it differs from clientAuth.
+	adminClientAuth *tls.ClientAuthType
+	// authorizer authorizes every request, if set.
+	authorizer Authorizer
+	// shutdown is the sequence of Server.Stop.
+	shutdown *shutdownPolicy
 
 	enableRPCLogging        bool
 	enableRPCPayloadLogging bool
@@ -80,6 +135,28 @@ func NewServerParamsFromConfig(cfg config.View, prefix string, listen func(netwo
 
 	p := NewServerParamsFromListeners(httpL)
 
+	// gRPC shares the HTTP port unless a different grpcport is configured.
+	grpcPort := cfg.GetInt(prefix + ".grpcport")
+	if grpcPort > 0 && grpcPort != cfg.GetInt(prefix+".httpport") {
+		p.grpcListener, err = listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
+			p.invalidate()
+			return nil, errors.Wrap(err, "can't start listener for grpc")
+		}
+	}
+
+	// The admin port keeps the telemetry and debug endpoints off the public
+	// port.
+	adminPort := cfg.GetInt(prefix + ".adminport")
+	if adminPort > 0 && adminPort != cfg.GetInt(prefix+".httpport") {
+		p.adminListener, err = listen("tcp", fmt.Sprintf(":%d", adminPort))
+		if err != nil {
+			p.invalidate()
+			return nil, errors.Wrap(err, "can't start listener for admin")
+		}
+		p.AdminMux = http.NewServeMux()
+	}
+
 	certFile := cfg.GetString(configNameServerPublicCertificateFile)
 	privateKeyFile := cfg.GetString(configNameServerPrivateKeyFile)
 	if len(certFile) > 0 && len(privateKeyFile) > 0 {
@@ -107,8 +184,34 @@ func NewServerParamsFromConfig(cfg config.View, prefix string, listen func(netwo
 			}
 		}
 		p.SetTLSConfiguration(rootPublicCertData, publicCertData, privateKeyData)
+		p.rootCaPublicCertificateFile = rootCertFile
+		p.publicCertificateFile = certFile
+		p.privateKeyFile = privateKeyFile
+		if cfg.IsSet(configNameServerCertificateExpiryWarning) {
+			p.certificateExpiryWarning = cfg.GetDuration(configNameServerCertificateExpiryWarning)
+		}
+
+		p.clientAuth, err = clientAuthType(cfg.GetString(configNameServerClientAuth))
+		if err != nil {
+			p.invalidate()
+			return nil, errors.WithStack(err)
+		}
+		if mode := cfg.GetString(configNameServerAdminClientAuth); mode != "" {
+			adminClientAuth, err := clientAuthType(mode)
+			if err != nil {
+				p.invalidate()
+				return nil, errors.WithStack(err)
+			}
+			p.SetAdminClientAuth(adminClientAuth)
+		}
+		p.tlsPolicy, err = newTLSPolicyFromConfig(cfg)
+		if err != nil {
+			p.invalidate()
+			return nil, errors.WithStack(err)
+		}
 	}
 
+	p.shutdown = newShutdownPolicyFromConfig(cfg)
 	p.enableMetrics = cfg.GetBool(telemetry.ConfigNameEnableMetrics)
 	p.enableRPCLogging = cfg.GetBool(ConfigNameEnableRPCLogging)
 	p.enableRPCPayloadLogging = logging.IsDebugEnabled(cfg)
@@ -119,9 +222,11 @@ func NewServerParamsFromConfig(cfg config.View, prefix string, listen func(netwo
 // NewServerParamsFromListeners returns server Params initialized with the ListenerHolder variables.
 func NewServerParamsFromListeners(httpL net.Listener) *ServerParams {
 	return &ServerParams{
-		ServeMux:       http.NewServeMux(),
-		handlerForHTTP: []HTTPHandler{},
-		httpListener:   httpL,
+		ServeMux:                 http.NewServeMux(),
+		handlerForHTTP:           []HTTPHandler{},
+		httpListener:             httpL,
+		certificateExpiryWarning: defaultCertificateExpiryWarning,
+		shutdown:                 &shutdownPolicy{drainTimeout: defaultDrainTimeout},
 	}
 }
 
@@ -136,6 +241,40 @@ func (p *ServerParams) SetTLSConfiguration(rootCaPublicCertificateFileData []byt
 	return p
 }
 
+// SetClientAuth sets the policy for client certificates in TLS mode.
+func (p *ServerParams) SetClientAuth(clientAuth tls.ClientAuthType) *ServerParams {
+	p.clientAuth = clientAuth
+	return p
+}
+
+// SetAdminClientAuth sets the policy for client certificates of the admin
+// port, which is the one of SetClientAuth by default.
+func (p *ServerParams) SetAdminClientAuth(clientAuth tls.ClientAuthType) *ServerParams {
+	p.adminClientAuth = &clientAuth
+	return p
+}
+
+// SetAuthorizer sets the Authorizer of all HTTP and gRPC requests. Handlers
+// can also use it through Authorize.
+func (p *ServerParams) SetAuthorizer(authorizer Authorizer) {
+	p.authorizer = authorizer
+}
+
+// TelemetryMux returns the router of the telemetry, health and debug
+// endpoints: AdminMux if there is an admin port, or ServeMux.
+func (p *ServerParams) TelemetryMux() *http.ServeMux {
+	if p.adminListener != nil {
+		return p.AdminMux
+	}
+	return p.ServeMux
+}
+
+// HasAdminPort returns true if the telemetry endpoints are served on their own
+// port.
+func (p *ServerParams) HasAdminPort() bool {
+	return p.adminListener != nil
+}
+
 // usingTLS returns true if a certificate is set.
 func (p *ServerParams) usingTLS() bool {
 	return len(p.publicCertificateFileData) > 0
@@ -148,6 +287,21 @@ func (p *ServerParams) AddHandleFunc(httpHandler HTTPHandler) {
 	}
 }
 
+// AddGrpcHandleFunc binds gRPC services to the server.
+func (p *ServerParams) AddGrpcHandleFunc(grpcHandler GRPCHandler) {
+	if grpcHandler != nil {
+		p.handlersForGrpc = append(p.handlersForGrpc, grpcHandler)
+	}
+}
+
+// AddGrpcProxyHandleFunc binds the JSON/REST gateway of a gRPC service. The
+// gateways are served at "/" of ServeMux.
+func (p *ServerParams) AddGrpcProxyHandleFunc(grpcProxyHandler GRPCProxyHandler) {
+	if grpcProxyHandler != nil {
+		p.handlersForGrpcProxy = append(p.handlersForGrpcProxy, grpcProxyHandler)
+	}
+}
+
 // AddHealthCheckFunc adds a readiness probe to tell Kubernetes the service is able to handle traffic.
 func (p *ServerParams) AddHealthCheckFunc(handlerFunc func(context.Context) error) {
 	if handlerFunc != nil {
@@ -160,33 +314,63 @@ func (p *ServerParams) invalidate() {
 	if err := p.httpListener.Close(); err != nil {
 		serverLogger.Errorf("error closing grpc-proxy handler, %s", err)
 	}
+	if p.grpcListener != nil {
+		if err := p.grpcListener.Close(); err != nil {
+			serverLogger.Errorf("error closing grpc handler, %s", err)
+		}
+	}
+	if p.adminListener != nil {
+		if err := p.adminListener.Close(); err != nil {
+			serverLogger.Errorf("error closing admin handler, %s", err)
+		}
+	}
 }
 
 // Server hosts a gRPC and HTTP server.
 // All HTTP traffic is served from a common http.ServeMux.
 type Server struct {
 	serverWithProxy grpcServerWithProxy
+	shutdown        *shutdownPolicy
 }
 
 // grpcServerWithProxy this will go away when insecure.go and tls.go are merged into the same server.
 type grpcServerWithProxy interface {
 	start(*ServerParams) error
-	stop() error
+	// stop waits for the requests in flight until ctx is done, then closes
+	// the remaining connections.
+	stop(ctx context.Context) error
 }
 
 // Start the gRPC+HTTP(s) REST server.
 func (s *Server) Start(p *ServerParams) error {
+	s.shutdown = p.shutdown
+	p.AddHealthCheckFunc(s.shutdown.readinessCheck)
 	if p.usingTLS() {
-		s.serverWithProxy = newTLSServer(p.httpListener)
+		s.serverWithProxy = newTLSServer(p.httpListener, p.grpcListener)
 	} else {
-		s.serverWithProxy = newInsecureServer(p.httpListener)
+		s.serverWithProxy = newInsecureServer(p.httpListener, p.grpcListener)
 	}
 	return s.serverWithProxy.start(p)
 }
 
-// Stop the gRPC+HTTP(s) REST server.
+// Stop the gRPC+HTTP(s) REST server. The readiness probe fails from then on,
+// and the server keeps serving for the pre-stop delay, so that it is removed
+// from the load balancers before it closes its listeners. Then the requests
+// in flight are given the drain timeout to complete.
 func (s *Server) Stop() error {
-	return s.serverWithProxy.stop()
+	atomic.StoreInt32(&s.shutdown.draining, 1)
+	serverLogger.Info("Shutdown: readiness probe is failing")
+	if s.shutdown.preStopDelay > 0 {
+		serverLogger.Infof("Shutdown: waiting %s before closing the listeners", s.shutdown.preStopDelay)
+		time.Sleep(s.shutdown.preStopDelay)
+	}
+
+	serverLogger.Infof("Shutdown: draining requests in flight for up to %s", s.shutdown.drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdown.drainTimeout)
+	defer cancel()
+	err := s.serverWithProxy.stop(ctx)
+	serverLogger.Info("Shutdown: server stopped")
+	return err
 }
 
 type loggingHTTPHandler struct {
@@ -210,6 +394,10 @@ func (l *loggingHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 }
 
 func instrumentHTTPHandler(handler http.Handler, params *ServerParams) http.Handler {
+	handler = &identityHTTPHandler{
+		handler:    handler,
+		authorizer: params.authorizer,
+	}
 	if params.enableMetrics {
 		handler = &ochttp.Handler{
 			Handler:     handler,
@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"siody.home/om-like/internal/config"
+)
+
+const (
+	configNameShutdownPreStopDelay = "api.shutdown.preStopDelay"
+	configNameShutdownDrainTimeout = "api.shutdown.drainTimeout"
+
+	// defaultDrainTimeout is how long the requests in flight may take to
+	// complete before their connections are closed.
+	defaultDrainTimeout = 30 * time.Second
+)
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+
+	shutdownConfigFields = []config.Field{
+		{Key: configNameShutdownPreStopDelay, Type: config.TypeDuration},
+		{Key: configNameShutdownDrainTimeout, Type: config.TypeDuration},
+	}
+)
+
+// shutdownPolicy is the sequence of Server.Stop. The server first fails its
+// readiness probe, then waits preStopDelay so that load balancers stop
+// sending it requests, then waits up to drainTimeout for the requests in
+// flight, and finally closes the remaining connections.
+type shutdownPolicy struct {
+	preStopDelay time.Duration
+	drainTimeout time.Duration
+
+	draining int32
+}
+
+func newShutdownPolicyFromConfig(cfg config.View) *shutdownPolicy {
+	p := &shutdownPolicy{
+		preStopDelay: cfg.GetDuration(configNameShutdownPreStopDelay),
+		drainTimeout: defaultDrainTimeout,
+	}
+	if cfg.IsSet(configNameShutdownDrainTimeout) {
+		p.drainTimeout = cfg.GetDuration(configNameShutdownDrainTimeout)
+	}
+	return p
+}
+
+// readinessCheck fails once the shutdown began.
+func (p *shutdownPolicy) readinessCheck(context.Context) error {
+	if atomic.LoadInt32(&p.draining) == 1 {
+		return errShuttingDown
+	}
+	return nil
+}
+
+// shutdownServers stops httpServer and grpcServer, waiting for the requests in
+// flight until ctx is done, then closing their connections. grpcServer is
+// served by httpServer through shared, or has its own listener if shared is
+// nil.
+func shutdownServers(ctx context.Context, httpServer *http.Server, grpcServer *grpc.Server, shared *sharedPortHandler) error {
+	done := make(chan error, 1)
+	go func() {
+		if shared == nil {
+			grpcServer.GracefulStop()
+			done <- httpServer.Shutdown(ctx)
+			return
+		}
+		err := httpServer.Shutdown(ctx)
+		if dErr := shared.drain(ctx); err == nil {
+			err = dErr
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		grpcServer.Stop()
+		return err
+	case <-ctx.Done():
+	}
+
+	serverLogger.Warning("Shutdown: drain timeout passed, closing the remaining connections")
+	grpcServer.Stop()
+	err := httpServer.Close()
+	<-done
+	return err
+}
@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// holdStreamDesc is a stream which the server answers once release is closed.
+var holdStreamDesc = &grpc.StreamDesc{StreamName: "Hold", ServerStreams: true, ClientStreams: true}
+
+func registerHoldService(release <-chan struct{}, started chan<- struct{}) GRPCHandler {
+	return func(s *grpc.Server) {
+		s.RegisterService(&grpc.ServiceDesc{
+			ServiceName: "test.Hold",
+			HandlerType: (*interface{})(nil),
+			Streams: []grpc.StreamDesc{{
+				StreamName:    "Hold",
+				ServerStreams: true,
+				ClientStreams: true,
+				Handler: func(srv interface{}, stream grpc.ServerStream) error {
+					if err := stream.RecvMsg(&healthpb.HealthCheckRequest{}); err != nil {
+						return err
+					}
+					started <- struct{}{}
+					select {
+					case <-release:
+					case <-stream.Context().Done():
+						return stream.Context().Err()
+					}
+					return stream.SendMsg(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+				},
+			}},
+		}, struct{}{})
+	}
+}
+
+// sharedPortServers returns the settings and client options of insecure and
+// TLS servers sharing the HTTP port with gRPC.
+func sharedPortServers(t *testing.T) map[string]func(*ServerParams) grpc.DialOption {
+	ca := newTestCA(t, "root")
+	cert, key := ca.issue(t, testCertificate{commonName: "server"})
+	return map[string]func(*ServerParams) grpc.DialOption{
+		"insecure": func(*ServerParams) grpc.DialOption {
+			return grpc.WithInsecure()
+		},
+		"tls": func(p *ServerParams) grpc.DialOption {
+			p.SetTLSConfiguration(ca.certPEM, cert, key)
+			return grpc.WithTransportCredentials(credentials.NewTLS(ca.clientConfig(t)))
+		},
+	}
+}
+
+// openHoldStream starts a Hold call on the server at addr, and waits until the
+// server handles it.
+func openHoldStream(t *testing.T, addr string, started <-chan struct{}, opt grpc.DialOption) grpc.ClientStream {
+	t.Helper()
+	conn, err := grpc.Dial(addr, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	stream, err := conn.NewStream(context.Background(), holdStreamDesc, "/test.Hold/Hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not start")
+	}
+	return stream
+}
+
+func TestServer_StopDrainsSharedPortStreams(t *testing.T) {
+	for name, configure := range sharedPortServers(t) {
+		t.Run(name, func(t *testing.T) {
+			release, started := make(chan struct{}), make(chan struct{}, 1)
+			l := mustListen(t)
+			p := NewServerParamsFromListeners(l)
+			opt := configure(p)
+			p.shutdown.drainTimeout = 5 * time.Second
+			p.AddGrpcHandleFunc(registerHoldService(release, started))
+			s := &Server{}
+			if err := s.Start(p); err != nil {
+				t.Fatal(err)
+			}
+			stream := openHoldStream(t, l.Addr().String(), started, opt)
+
+			stopped := make(chan error, 1)
+			go func() { stopped <- s.Stop() }()
+			select {
+			case err := <-stopped:
+				t.Fatalf("expected Stop to wait for the stream, got %v", err)
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			// The stream in flight completes after the shutdown began.
+			close(release)
+			resp := &healthpb.HealthCheckResponse{}
+			if err := stream.RecvMsg(resp); err != nil {
+				t.Fatalf("expected the stream to complete, got %v", err)
+			}
+			if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Fatalf("unexpected response %s", resp.Status)
+			}
+			select {
+			case err := <-stopped:
+				if err != nil && err != http.ErrServerClosed {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Stop did not return once the stream completed")
+			}
+		})
+	}
+}
+
+func TestServer_StopClosesStreamsAfterDrainTimeout(t *testing.T) {
+	for name, configure := range sharedPortServers(t) {
+		t.Run(name, func(t *testing.T) {
+			release, started := make(chan struct{}), make(chan struct{}, 1)
+			defer close(release)
+			l := mustListen(t)
+			p := NewServerParamsFromListeners(l)
+			opt := configure(p)
+			p.shutdown.drainTimeout = 100 * time.Millisecond
+			p.AddGrpcHandleFunc(registerHoldService(release, started))
+			s := &Server{}
+			if err := s.Start(p); err != nil {
+				t.Fatal(err)
+			}
+			stream := openHoldStream(t, l.Addr().String(), started, opt)
+
+			start := time.Now()
+			s.Stop()
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("expected Stop to give up after the drain timeout, took %s", elapsed)
+			}
+			err := stream.RecvMsg(&healthpb.HealthCheckResponse{})
+			if err == nil || status.Code(err) == codes.OK {
+				t.Fatal("expected the stream to be closed")
+			}
+		})
+	}
+}
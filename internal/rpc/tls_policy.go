@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"siody.home/om-like/internal/config"
+)
+
+const (
+	configNameServerMinVersion       = "api.tls.minVersion"
+	configNameServerMaxVersion       = "api.tls.maxVersion"
+	configNameServerCipherSuites     = "api.tls.cipherSuites"
+	configNameServerCurvePreferences = "api.tls.curvePreferences"
+	configNameServerSessionTickets   = "api.tls.sessionTickets"
+	configNameServerALPN             = "api.tls.alpn"
+	configNameServerAllowInsecure    = "api.tls.allowInsecure"
+
+	// defaultMinTLSVersion is the oldest version accepted when no minimum is
+	// configured.
+	defaultMinTLSVersion = tls.VersionTLS12
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+
+	tlsPolicyConfigFields = []config.Field{
+		{Key: configNameServerMinVersion, Type: config.TypeString},
+		{Key: configNameServerMaxVersion, Type: config.TypeString},
+		{Key: configNameServerCipherSuites, Type: config.TypeStringSlice},
+		{Key: configNameServerCurvePreferences, Type: config.TypeStringSlice},
+		{Key: configNameServerSessionTickets, Type: config.TypeBool},
+		{Key: configNameServerALPN, Type: config.TypeStringSlice},
+		{Key: configNameServerAllowInsecure, Type: config.TypeBool},
+	}
+)
+
+func tlsVersionNames() []string {
+	return []string{"1.0", "1.1", "1.2", "1.3"}
+}
+
+// tlsPolicy are the protocol settings of the TLS server.
+type tlsPolicy struct {
+	minVersion             uint16
+	maxVersion             uint16
+	cipherSuites           []uint16
+	curvePreferences       []tls.CurveID
+	sessionTicketsDisabled bool
+	alpn                   []string
+	// allowInsecure permits the settings refused by validate.
+	allowInsecure bool
+}
+
+// newTLSPolicyFromConfig reads the TLS policy from cfg. Unset keys keep the
+// defaults of crypto/tls, except for the minimum version, which defaults to
+// TLS 1.2.
+func newTLSPolicyFromConfig(cfg config.View) (*tlsPolicy, error) {
+	p := &tlsPolicy{
+		minVersion:             defaultMinTLSVersion,
+		sessionTicketsDisabled: cfg.IsSet(configNameServerSessionTickets) && !cfg.GetBool(configNameServerSessionTickets),
+		alpn:                   cfg.GetStringSlice(configNameServerALPN),
+		allowInsecure:          cfg.GetBool(configNameServerAllowInsecure),
+	}
+
+	var err error
+	if v := cfg.GetString(configNameServerMinVersion); v != "" {
+		if p.minVersion, err = parseTLSVersion(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := cfg.GetString(configNameServerMaxVersion); v != "" {
+		if p.maxVersion, err = parseTLSVersion(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range cfg.GetStringSlice(configNameServerCipherSuites) {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		p.cipherSuites = append(p.cipherSuites, id)
+	}
+	for _, name := range cfg.GetStringSlice(configNameServerCurvePreferences) {
+		id, ok := tlsCurves[strings.ToUpper(strings.Replace(name, "-", "", -1))]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS curve %q", name)
+		}
+		p.curvePreferences = append(p.curvePreferences, id)
+	}
+
+	if err = p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseTLSVersion parses versions such as 1.2 or TLS1.2. YAML reads 1.0 as a
+// number, which is formatted as 1.
+func parseTLSVersion(v string) (uint16, error) {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "tls")
+	if !strings.Contains(name, ".") {
+		name += ".0"
+	}
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected one of %s", v, strings.Join(tlsVersionNames(), ", "))
+	}
+	return version, nil
+}
+
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(suite.Name, name) {
+			return suite.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown TLS cipher suite %q", name)
+}
+
+// validate returns an error if the policy cannot work, or if it is insecure
+// and allowInsecure is not set.
+func (p *tlsPolicy) validate() error {
+	if p.maxVersion != 0 && p.maxVersion < p.minVersion {
+		return fmt.Errorf("%s is lower than %s", configNameServerMaxVersion, configNameServerMinVersion)
+	}
+	if len(p.cipherSuites) > 0 && p.minVersion < tls.VersionTLS13 && !hasHTTP2CipherSuite(p.cipherSuites) {
+		return fmt.Errorf("%s lacks TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 and gRPC require", configNameServerCipherSuites)
+	}
+	if p.allowInsecure {
+		return nil
+	}
+
+	var problems []string
+	if p.minVersion < tls.VersionTLS12 {
+		problems = append(problems, "TLS versions before 1.2 are insecure")
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		for _, id := range p.cipherSuites {
+			if id == suite.ID {
+				problems = append(problems, fmt.Sprintf("cipher suite %s is insecure", suite.Name))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("insecure TLS configuration, set %s to use it anyway: %s", configNameServerAllowInsecure, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func hasHTTP2CipherSuite(suites []uint16) bool {
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the policy on cfg. The ALPN protocols are added after the ones
+// cfg already has.
+func (p *tlsPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.minVersion
+	cfg.MaxVersion = p.maxVersion
+	cfg.CipherSuites = p.cipherSuites
+	cfg.CurvePreferences = p.curvePreferences
+	cfg.SessionTicketsDisabled = p.sessionTicketsDisabled
+	for _, proto := range p.alpn {
+		if !containsString(cfg.NextProtos, proto) {
+			cfg.NextProtos = append(cfg.NextProtos, proto)
+		}
+	}
+}
+
+func containsString(l []string, s string) bool {
+	for _, item := range l {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// readTLSPolicy reads the TLS policy of the api.tls section in YAML.
+func readTLSPolicy(t *testing.T, settings string) (*tlsPolicy, error) {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader("api:\n  tls:\n" + settings)); err != nil {
+		t.Fatal(err)
+	}
+	return newTLSPolicyFromConfig(v)
+}
+
+func TestTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		expected *tlsPolicy
+	}{
+		{
+			name:     "defaults",
+			expected: &tlsPolicy{minVersion: tls.VersionTLS12},
+		},
+		{
+			name: "all settings",
+			settings: `    minVersion: TLS1.2
+    maxVersion: "1.3"
+    cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls_ecdhe_ecdsa_with_chacha20_poly1305_sha256]
+    curvePreferences: [x25519, P-256]
+    sessionTickets: false
+    alpn: [http/1.1]
+`,
+			expected: &tlsPolicy{
+				minVersion:             tls.VersionTLS12,
+				maxVersion:             tls.VersionTLS13,
+				cipherSuites:           []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+				curvePreferences:       []tls.CurveID{tls.X25519, tls.CurveP256},
+				sessionTicketsDisabled: true,
+				alpn:                   []string{"http/1.1"},
+			},
+		},
+		{
+			// YAML reads 1.0 as a number.
+			name:     "version read as a number",
+			settings: "    minVersion: 1.0\n    allowInsecure: true\n",
+			expected: &tlsPolicy{minVersion: tls.VersionTLS10, allowInsecure: true},
+		},
+		{
+			name:     "insecure suite allowed",
+			settings: "    cipherSuites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_RC4_128_SHA]\n    allowInsecure: true\n",
+			expected: &tlsPolicy{
+				minVersion:    tls.VersionTLS12,
+				cipherSuites:  []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_RC4_128_SHA},
+				allowInsecure: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := readTLSPolicy(t, tt.settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, p)
+			}
+		})
+	}
+}
+
+func TestTLSPolicy_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		err      string
+	}{
+		{name: "unknown version", settings: "    minVersion: \"1.4\"\n", err: `unknown TLS version "1.4"`},
+		{name: "unknown suite", settings: "    cipherSuites: [TLS_NOPE]\n", err: `unknown TLS cipher suite "TLS_NOPE"`},
+		{name: "unknown curve", settings: "    curvePreferences: [P-128]\n", err: `unknown TLS curve "P-128"`},
+		{name: "max lower than min", settings: "    minVersion: \"1.3\"\n    maxVersion: \"1.2\"\n", err: "api.tls.maxVersion is lower than api.tls.minVersion"},
+		{name: "missing HTTP/2 suite", settings: "    cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]\n", err: "which HTTP/2 and gRPC require"},
+		{name: "insecure version", settings: "    minVersion: 1.0\n", err: "TLS versions before 1.2 are insecure"},
+		{name: "insecure suite", settings: "    cipherSuites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_RC4_128_SHA]\n", err: "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readTLSPolicy(t, tt.settings)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestTLSPolicy_Apply(t *testing.T) {
+	p := &tlsPolicy{minVersion: tls.VersionTLS13, alpn: []string{http2WithTLSVersionID, "http/1.1"}}
+	cfg := &tls.Config{NextProtos: []string{http2WithTLSVersionID}}
+	p.apply(cfg)
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3, got %x", cfg.MinVersion)
+	}
+	if expected := []string{http2WithTLSVersionID, "http/1.1"}; !reflect.DeepEqual(cfg.NextProtos, expected) {
+		t.Fatalf("expected ALPN %v, got %v", expected, cfg.NextProtos)
+	}
+}
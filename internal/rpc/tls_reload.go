@@ -0,0 +1,276 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"siody.home/om-like/internal/filewatch"
+)
+
+const (
+	configNameServerCertificateExpiryWarning = "api.tls.expiryWarning"
+
+	// defaultCertificateExpiryWarning is how long before the server
+	// certificate expires the health check starts warning about it.
+	defaultCertificateExpiryWarning = 7 * 24 * time.Hour
+
+	// certificateWarningInterval limits how often the health check logs the
+	// upcoming expiry, as probes run every few seconds.
+	certificateWarningInterval = time.Hour
+)
+
+var (
+	keyCertificate = tag.MustNewKey("certificate")
+
+	mCertificateExpiry = stats.Int64("rpc/tls_certificate_expiry", "Unix time when the TLS certificate expires", stats.UnitSeconds)
+
+	certificateExpiryView = &view.View{
+		Measure:     mCertificateExpiry,
+		Name:        "rpc/tls_certificate_expiry",
+		Description: "Unix time when the TLS certificate expires",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyCertificate},
+	}
+)
+
+// certStore holds the TLS certificate of the server and the root CA it
+// trusts. When they are read from files, the files are watched and reloaded
+// when they change, so that rotated certificates are used for new connections
+// without restarting the listener.
+type certStore struct {
+	rootFile, certFile, keyFile string
+	expiryWarning               time.Duration
+	// client is true for the client certificate of HTTP clients, which is
+	// labeled client in the expiry metric, and whose loads are only logged
+	// at debug level, as every client has its own store.
+	client bool
+
+	m           sync.RWMutex
+	cert        *tls.Certificate
+	roots       *x509.CertPool
+	lastWarning time.Time
+
+	watcher *filewatch.Watcher
+}
+
+// newStaticCertStore returns a certStore of PEM data which never changes.
+func newStaticCertStore(rootData, certData, keyData []byte, expiryWarning time.Duration) (*certStore, error) {
+	c := &certStore{expiryWarning: expiryWarning}
+	if err := c.set(rootData, certData, keyData); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newFileCertStore returns a certStore of PEM files, which are reloaded when
+// they change. If rootFile is empty, the certificate is its own root.
+func newFileCertStore(rootFile, certFile, keyFile string, expiryWarning time.Duration) (*certStore, error) {
+	c := &certStore{
+		rootFile:      rootFile,
+		certFile:      certFile,
+		keyFile:       keyFile,
+		expiryWarning: expiryWarning,
+	}
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newClientCertStore is newFileCertStore for the client certificate of HTTP
+// clients.
+func newClientCertStore(rootFile, certFile, keyFile string) (*certStore, error) {
+	c := &certStore{
+		rootFile: rootFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+		client:   true,
+	}
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// start loads the files and watches them.
+func (c *certStore) start() error {
+	if err := c.load(); err != nil {
+		return err
+	}
+	return c.watch()
+}
+
+func (c *certStore) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.rootFile != "" {
+		files = append(files, c.rootFile)
+	}
+	return files
+}
+
+// load reads the files and replaces the certificate and the roots.
+func (c *certStore) load() error {
+	certData, err := ioutil.ReadFile(c.certFile)
+	if err != nil {
+		return errors.WithStack(fmt.Errorf("cannot read TLS server public certificate file, %s, %s", c.certFile, err))
+	}
+	keyData, err := ioutil.ReadFile(c.keyFile)
+	if err != nil {
+		return errors.WithStack(fmt.Errorf("cannot read TLS server private key file, %s, %s", c.keyFile, err))
+	}
+	rootData := certData
+	if c.rootFile != "" {
+		rootData, err = ioutil.ReadFile(c.rootFile)
+		if err != nil {
+			return errors.WithStack(fmt.Errorf("cannot read TLS server root certificate file, %s, %s", c.rootFile, err))
+		}
+	}
+	return c.set(rootData, certData, keyData)
+}
+
+func (c *certStore) set(rootData, certData, keyData []byte) error {
+	if len(rootData) == 0 {
+		rootData = certData
+	}
+	roots, err := trustedCertificateFromFileData(rootData)
+	if err != nil {
+		return err
+	}
+	cert, err := certificateFromFileData(certData, keyData)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	c.cert = cert
+	c.roots = roots
+	c.m.Unlock()
+
+	fields := logrus.Fields{
+		"subject": cert.Leaf.Subject.String(),
+		"expires": cert.Leaf.NotAfter,
+	}
+	if c.client {
+		recordCertificateExpiry("client", cert.Leaf.NotAfter)
+		clientLogger.WithFields(fields).Debug("TLS client certificate loaded")
+		return nil
+	}
+	recordCertificateExpiry("server", cert.Leaf.NotAfter)
+	if root, err := rootCertificate(rootData); err == nil {
+		recordCertificateExpiry("root", root.NotAfter)
+	}
+	serverLogger.WithFields(fields).Info("TLS certificate loaded")
+	return nil
+}
+
+func recordCertificateExpiry(certificate string, notAfter time.Time) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(keyCertificate, certificate))
+	if err != nil {
+		serverLogger.WithError(err).Warning("cannot tag TLS certificate metrics")
+		return
+	}
+	stats.Record(ctx, mCertificateExpiry.M(notAfter.Unix()))
+}
+
+func (c *certStore) current() (*tls.Certificate, *x509.CertPool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cert, c.roots
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate, for
+// connections of the server to itself and of clients to other services.
+func (c *certStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// configForClient returns a tls.Config.GetConfigForClient serving base with
+// the current certificate and client roots.
+func (c *certStore) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, roots := c.current()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*cert}
+		cfg.ClientCAs = roots
+		return cfg, nil
+	}
+}
+
+// healthCheck fails once the server certificate expired, and logs a warning
+// when it expires within expiryWarning.
+func (c *certStore) healthCheck(context.Context) error {
+	cert, _ := c.current()
+	left := time.Until(cert.Leaf.NotAfter)
+	if left <= 0 {
+		return fmt.Errorf("TLS certificate %s expired at %s", cert.Leaf.Subject, cert.Leaf.NotAfter)
+	}
+	if left > c.expiryWarning {
+		return nil
+	}
+
+	c.m.Lock()
+	warn := time.Since(c.lastWarning) >= certificateWarningInterval
+	if warn {
+		c.lastWarning = time.Now()
+	}
+	c.m.Unlock()
+	if warn {
+		serverLogger.WithFields(logrus.Fields{
+			"subject": cert.Leaf.Subject.String(),
+			"expires": cert.Leaf.NotAfter,
+		}).Warningf("TLS certificate expires in %s", left.Round(time.Minute))
+	}
+	return nil
+}
+
+// watch reloads the files when they, or the symlinks to them, change.
+func (c *certStore) watch() error {
+	w, err := filewatch.New(filewatch.DefaultDebounce, c.reload, func(err error) {
+		serverLogger.WithError(err).Warning("error watching TLS certificate files")
+	})
+	if err != nil {
+		return err
+	}
+	if err = w.Watch(c.files(), nil, nil); err != nil {
+		w.Close()
+		return err
+	}
+	c.watcher = w
+	return nil
+}
+
+func (c *certStore) reload() {
+	logger := serverLogger
+	if c.client {
+		logger = clientLogger
+	}
+	if err := c.load(); err != nil {
+		logger.WithError(err).Error("cannot reload TLS certificate, keeping the current certificate")
+	}
+}
+
+// close stops watching the files.
+func (c *certStore) close() error {
+	if c.watcher != nil {
+		return c.watcher.Close()
+	}
+	return nil
+}
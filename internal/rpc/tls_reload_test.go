@@ -0,0 +1,128 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"siody.home/om-like/internal/config"
+	"siody.home/om-like/internal/filewatch"
+)
+
+func listenLocal(network, address string) (net.Listener, error) {
+	return net.Listen(network, "127.0.0.1:0")
+}
+
+// tempDir returns a directory removed at the end of the test, and a function
+// writing files into it.
+func tempDir(t *testing.T) (string, func(name string, data []byte) string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir, func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+}
+
+// handshake returns the common name of the certificate served at addr.
+func handshake(t *testing.T, addr string, cfg *tls.Config) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertStore_HotReload(t *testing.T) {
+	ca := newTestCA(t, "root")
+	_, write := tempDir(t)
+	cert, key := ca.issue(t, testCertificate{commonName: "before"})
+	cfg := config.NewMemory()
+	cfg.Set("api.test.httpport", 0)
+	cfg.Set(configNameServerRootCertificatePath, write("ca.crt", ca.certPEM))
+	cfg.Set(configNameServerPublicCertificateFile, write("tls.crt", cert))
+	cfg.Set(configNameServerPrivateKeyFile, write("tls.key", key))
+
+	p, err := NewServerParamsFromConfig(cfg, "api.test", listenLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := p.httpListener.Addr().String()
+	startServer(t, p)
+
+	if cn := handshake(t, addr, ca.clientConfig(t)); cn != "before" {
+		t.Fatalf("expected the initial certificate, got %s", cn)
+	}
+
+	// The listener keeps running while the files are rotated; new handshakes
+	// get the new certificate once the files settled.
+	cert, key = ca.issue(t, testCertificate{commonName: "after"})
+	write("tls.crt", cert)
+	write("tls.key", key)
+	deadline := time.Now().Add(5 * time.Second)
+	for handshake(t, addr, ca.clientConfig(t)) != "after" {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated certificate was not served")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCertStore_KeepsCertificateOnBadReload(t *testing.T) {
+	ca := newTestCA(t, "root")
+	_, write := tempDir(t)
+	cert, key := ca.issue(t, testCertificate{commonName: "good"})
+	certFile, keyFile := write("tls.crt", cert), write("tls.key", key)
+
+	store, err := newFileCertStore("", certFile, keyFile, defaultCertificateExpiryWarning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	write("tls.key", []byte("not a key"))
+	time.Sleep(filewatch.DefaultDebounce + 500*time.Millisecond)
+	current, _ := store.current()
+	if current.Leaf.Subject.CommonName != "good" {
+		t.Fatalf("expected the last good certificate, got %s", current.Leaf.Subject.CommonName)
+	}
+}
+
+func TestCertStore_HealthCheck(t *testing.T) {
+	ca := newTestCA(t, "root")
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		fail     bool
+	}{
+		{name: "valid", notAfter: time.Now().Add(30 * 24 * time.Hour)},
+		{name: "expiring", notAfter: time.Now().Add(time.Hour)},
+		{name: "expired", notAfter: time.Now().Add(-time.Minute), fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, key := ca.issue(t, testCertificate{commonName: tt.name, notAfter: tt.notAfter})
+			store, err := newStaticCertStore(ca.certPEM, cert, key, defaultCertificateExpiryWarning)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.healthCheck(context.Background()); (err != nil) != tt.fail {
+				t.Fatalf("expected failure %v, got %v", tt.fail, err)
+			}
+		})
+	}
+}
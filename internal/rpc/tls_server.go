@@ -7,6 +7,8 @@ import (
 	"net/http"
 
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"siody.home/om-like/internal/telemetry"
 )
@@ -20,19 +22,73 @@ type tlsServer struct {
 	httpListener net.Listener
 	httpMux      *http.ServeMux
 	httpServer   *http.Server
+
+	grpcListener net.Listener
+	grpcServer   *grpc.Server
+	proxyCancel  context.CancelFunc
+	// shared serves gRPC on the HTTP port, if there is no gRPC listener.
+	shared *sharedPortHandler
+	certs  *certStore
+
+	adminServer *http.Server
 }
 
 func (s *tlsServer) start(params *ServerParams) error {
 	s.httpMux = params.ServeMux
 
-	rootCaCert, err := trustedCertificateFromFileData(params.rootCaPublicCertificateFileData)
+	// The certificates are read from files when possible, so that they can be
+	// rotated without restarting the server.
+	var err error
+	if params.publicCertificateFile != "" {
+		s.certs, err = newFileCertStore(params.rootCaPublicCertificateFile, params.publicCertificateFile, params.privateKeyFile, params.certificateExpiryWarning)
+	} else {
+		s.certs, err = newStaticCertStore(params.rootCaPublicCertificateFileData, params.publicCertificateFileData, params.privateKeyFileData, params.certificateExpiryWarning)
+	}
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	// When client certificates are required, the gateway presents the server
+	// certificate, so it must be valid for client authentication.
+	requireClientCert := params.clientAuth == tls.RequireAnyClientCert || params.clientAuth == tls.RequireAndVerifyClientCert
+	if len(params.handlersForGrpcProxy) > 0 && requireClientCert {
+		cert, _ := s.certs.current()
+		if err := checkClientCertificate(cert.Leaf); err != nil {
+			s.certs.close()
+			return errors.Wrap(err, "the JSON/REST gateway cannot present the server certificate to the gRPC server")
+		}
+	}
+	params.AddHealthCheckFunc(s.certs.healthCheck)
 
-	tlsCertificate, err := certificateFromFileData(params.publicCertificateFileData, params.privateKeyFileData)
+	tlsConfig := &tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		ClientAuth:     params.clientAuth,
+		NextProtos:     []string{http2WithTLSVersionID},
+		MinVersion:     defaultMinTLSVersion,
+	}
+	if params.tlsPolicy != nil {
+		params.tlsPolicy.apply(tlsConfig)
+	}
+	adminConfig := adminTLSConfig(tlsConfig, s.certs, params)
+	tlsConfig.GetConfigForClient = s.certs.configForClient(tlsConfig)
+
+	gatewayToken, err := newGatewayToken()
 	if err != nil {
-		return errors.WithStack(err)
+		s.certs.close()
+		return err
+	}
+
+	// Bind gRPC handlers
+	if s.grpcListener == nil {
+		s.grpcServer = newGrpcServer(params, gatewayToken)
+	} else {
+		s.grpcServer = newGrpcServer(params, gatewayToken, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		go func() {
+			serverLogger.Infof("Serving gRPC with TLS: %s", s.grpcListener.Addr().String())
+			gErr := s.grpcServer.Serve(s.grpcListener)
+			if gErr != nil && gErr != grpc.ErrServerStopped {
+				serverLogger.Debugf("error serving gRPC: %s", gErr)
+			}
+		}()
 	}
 
 	// Start HTTP server
@@ -40,18 +96,46 @@ func (s *tlsServer) start(params *ServerParams) error {
 		handlerFunc(s.httpMux)
 	}
 
+	// Bind the JSON/REST gateway to the gRPC services, trusting the same root
+	// CA as the clients. The gateway token proves that calls come from the
+	// gateway, and carries the identity of its caller, so the gateway only
+	// presents the server certificate when the handshake requires one.
+	if len(params.handlersForGrpcProxy) > 0 {
+		var ctx context.Context
+		ctx, s.proxyCancel = context.WithCancel(context.Background())
+		grpcL := s.grpcListener
+		if grpcL == nil {
+			grpcL = s.httpListener
+		}
+		cert, roots := s.certs.current()
+		clientConfig := &tls.Config{RootCAs: roots}
+		if requireClientCert {
+			clientConfig.GetClientCertificate = s.certs.getClientCertificate
+		}
+		if len(cert.Leaf.DNSNames) > 0 {
+			clientConfig.ServerName = cert.Leaf.DNSNames[0]
+		}
+		proxy, err := newGrpcProxy(ctx, params, gatewayToken, localEndpoint(grpcL), []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)),
+		})
+		if err != nil {
+			s.proxyCancel()
+			return err
+		}
+		s.httpMux.Handle("/", proxy)
+	}
+
 	// Bind HTTPS handlers
-	s.httpMux.Handle(telemetry.HealthCheckEndpoint, telemetry.NewHealthCheck(params.handlersForHealthCheck))
+	params.TelemetryMux().Handle(telemetry.HealthCheckEndpoint, telemetry.NewHealthCheck(params.handlersForHealthCheck))
+	handler := instrumentHTTPHandler(s.httpMux, params)
+	if s.grpcListener == nil {
+		s.shared = newSharedPortHandler(s.grpcServer, handler)
+		handler = s.shared
+	}
 	s.httpServer = &http.Server{
-		Addr:    s.httpListener.Addr().String(),
-		Handler: instrumentHTTPHandler(s.httpMux, params),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{*tlsCertificate},
-			ClientCAs:    rootCaCert,
-			// Don`t support mutual authentication yet
-			//ClientAuth:   tls.RequireAndVerifyClientCert,
-			NextProtos: []string{http2WithTLSVersionID},
-		},
+		Addr:      s.httpListener.Addr().String(),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
 	}
 	go func() {
 		tlsListener := tls.NewListener(s.httpListener, s.httpServer.TLSConfig)
@@ -62,17 +146,29 @@ func (s *tlsServer) start(params *ServerParams) error {
 		}
 	}()
 
+	s.adminServer = startAdminServer(params, adminConfig)
+
 	return nil
 }
 
-func (s *tlsServer) stop() error {
+func (s *tlsServer) stop(ctx context.Context) error {
 	// the servers also close their respective listeners.
-	err := s.httpServer.Shutdown(context.Background())
+	err := shutdownServers(ctx, s.httpServer, s.grpcServer, s.shared)
+	if s.proxyCancel != nil {
+		s.proxyCancel()
+	}
+	if aErr := closeAdminServer(s.adminServer); err == nil {
+		err = aErr
+	}
+	if cErr := s.certs.close(); err == nil {
+		err = cErr
+	}
 	return err
 }
 
-func newTLSServer(httpL net.Listener) *tlsServer {
+func newTLSServer(httpL, grpcL net.Listener) *tlsServer {
 	return &tlsServer{
 		httpListener: httpL,
+		grpcListener: grpcL,
 	}
 }
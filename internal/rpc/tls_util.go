@@ -5,6 +5,7 @@ import (
 
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 
 	"github.com/pkg/errors"
 )
@@ -27,4 +28,28 @@ func certificateFromFileData(publicCertFileData []byte, privateKeyFileData []byt
 		return nil, errors.WithStack(err)
 	}
 	return &cert, nil
-}
\ No newline at end of file
+}
+
+// rootCertificate parses the first certificate of publicCertFileData.
+func rootCertificate(publicCertFileData []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(publicCertFileData)
+	if block == nil {
+		return nil, errors.New("rootCertificate: no PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// checkClientCertificate returns an error if cert may not authenticate TLS
+// clients, because its extended key usages leave out client auth, like the
+// ones of many server certificates.
+func checkClientCertificate(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) == 0 {
+		return nil
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageClientAuth || usage == x509.ExtKeyUsageAny {
+			return nil
+		}
+	}
+	return errors.WithStack(fmt.Errorf("certificate %s is not valid for TLS client authentication, its extended key usage does not include clientAuth", cert.Subject))
+}
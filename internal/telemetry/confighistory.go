@@ -0,0 +1,68 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"siody.home/om-like/internal/config"
+)
+
+const (
+	// ConfigHistoryEndpoint serves the recently applied configuration versions.
+	// POST ConfigHistoryEndpoint?rollback=<version> rolls back to a version
+	// if configNameEnableConfigRollback is set.
+	ConfigHistoryEndpoint          = "/confighistory"
+	configNameEnableConfigRollback = "telemetry.configHistory.enableRollback"
+)
+
+// configHistory is implemented by config.Store.
+type configHistory interface {
+	History() config.History
+	Rollback(number int) error
+}
+
+func bindConfigHistory(p Params, b Bindings) error {
+	h, ok := p.Config().(configHistory)
+	if !ok {
+		logger.Info("Config History: Unavailable")
+		return nil
+	}
+	enableRollback := p.Config().GetBool(configNameEnableConfigRollback)
+	logger.WithFields(logrus.Fields{
+		"endpoint":       ConfigHistoryEndpoint,
+		"enableRollback": enableRollback,
+	}).Info("Config History: ENABLED")
+
+	b.TelemetryHandleFunc(ConfigHistoryEndpoint, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !enableRollback {
+				http.Error(w, "configuration rollback is disabled", http.StatusForbidden)
+				return
+			}
+			number, err := strconv.Atoi(req.URL.Query().Get("rollback"))
+			if err != nil {
+				http.Error(w, "rollback must be a version number", http.StatusBadRequest)
+				return
+			}
+			if err = h.Rollback(number); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(h.History()); err != nil {
+			logger.WithError(err).Warning("cannot write configuration history")
+		}
+	})
+	return nil
+}
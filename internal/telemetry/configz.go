@@ -0,0 +1,61 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"siody.home/om-like/internal/config"
+)
+
+const (
+	// ConfigzEndpoint serves the effective configuration as JSON, or as YAML
+	// with ?format=yaml or an Accept header asking for YAML.
+	ConfigzEndpoint = "/configz"
+)
+
+// configDescriber is implemented by config.Store.
+type configDescriber interface {
+	Version() config.Version
+	Settings() []config.Setting
+}
+
+type configz struct {
+	Version  config.Version   `json:"version" yaml:"version"`
+	Settings []config.Setting `json:"settings" yaml:"settings"`
+}
+
+func bindConfigz(p Params, b Bindings) error {
+	d, ok := p.Config().(configDescriber)
+	if !ok {
+		logger.Info("Configz: Unavailable")
+		return nil
+	}
+	logger.WithFields(logrus.Fields{
+		"endpoint": ConfigzEndpoint,
+	}).Info("Configz: ENABLED")
+
+	b.TelemetryHandleFunc(ConfigzEndpoint, func(w http.ResponseWriter, req *http.Request) {
+		c := configz{
+			Version:  d.Version(),
+			Settings: d.Settings(),
+		}
+		if req.URL.Query().Get("format") == "yaml" || strings.Contains(req.Header.Get("Accept"), "yaml") {
+			w.Header().Set("Content-Type", "application/x-yaml")
+			if err := yaml.NewEncoder(w).Encode(c); err != nil {
+				logger.WithError(err).Warning("cannot write configz")
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(c); err != nil {
+			logger.WithError(err).Warning("cannot write configz")
+		}
+	})
+	return nil
+}
@@ -0,0 +1,40 @@
+package telemetry
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// grpcHealthServer implements the gRPC health checking protocol with the same
+// probes as the HTTP readiness check.
+type grpcHealthServer struct {
+	probe *statefulProbe
+}
+
+// NewGrpcHealthCheck creates a gRPC health service which reports SERVING when
+// all the probes succeed. Every service name gets the status of the server.
+func NewGrpcHealthCheck(probes []func(context.Context) error) healthpb.HealthServer {
+	return &grpcHealthServer{
+		probe: &statefulProbe{
+			healthState: new(int32),
+			probes:      probes,
+		},
+	}
+}
+
+// Check implements healthpb.HealthServer.
+func (s *grpcHealthServer) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if err := s.probe.check(ctx); err != nil {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+// Watch implements healthpb.HealthServer. Probes are only run on demand, so
+// status changes cannot be streamed.
+func (s *grpcHealthServer) Watch(_ *healthpb.HealthCheckRequest, _ healthpb.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "health status is only available with Check")
+}
@@ -0,0 +1,30 @@
+package telemetry
+
+import (
+	"net/http/pprof"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PprofEndpoint is the prefix of the profiling endpoints. They are only
+	// served on the admin port, which game clients cannot reach.
+	PprofEndpoint = "/debug/pprof/"
+)
+
+func bindPprof(p Params, b Bindings) error {
+	if !b.HasAdminPort() {
+		logger.Info("Pprof: Unavailable without an admin port")
+		return nil
+	}
+	logger.WithFields(logrus.Fields{
+		"endpoint": PprofEndpoint,
+	}).Info("Pprof: ENABLED")
+
+	b.TelemetryHandleFunc(PprofEndpoint, pprof.Index)
+	b.TelemetryHandleFunc(PprofEndpoint+"cmdline", pprof.Cmdline)
+	b.TelemetryHandleFunc(PprofEndpoint+"profile", pprof.Profile)
+	b.TelemetryHandleFunc(PprofEndpoint+"symbol", pprof.Symbol)
+	b.TelemetryHandleFunc(PprofEndpoint+"trace", pprof.Trace)
+	return nil
+}
@@ -27,31 +27,39 @@ func (sp *statefulProbe) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if len(req.URL.Query()) > 0 {
 		// Readiness probe are triggered if there's a query (ie "?" in the url).
 		// If so then scan all the probes.
-		for _, probe := range sp.probes {
-			err := probe(req.Context())
-			if err != nil {
-				old := atomic.SwapInt32(sp.healthState, healthStateUnhealthy)
-				if old == healthStateUnhealthy {
-					logger.WithError(err).Warningf("%s health check continues to fail. The server is at risk of termination.", HealthCheckEndpoint)
-				} else {
-					logger.WithError(err).Warningf("%s health check failed. The server will terminate if this continues to happen.", HealthCheckEndpoint)
-				}
-				http.Error(w, err.Error(), http.StatusServiceUnavailable)
-				return
-			}
-		}
-
-		old := atomic.SwapInt32(sp.healthState, healthStateHealthy)
-		if old == healthStateUnhealthy {
-			logger.Infof("%s is healthy again.", HealthCheckEndpoint)
-		} else if old == healthStateFirstProbe {
-			logger.Infof("%s is reporting healthy.", HealthCheckEndpoint)
+		if err := sp.check(req.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
 	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "ok")
 }
 
+// check runs all the probes and logs changes of the health status.
+func (sp *statefulProbe) check(ctx context.Context) error {
+	for _, probe := range sp.probes {
+		err := probe(ctx)
+		if err != nil {
+			old := atomic.SwapInt32(sp.healthState, healthStateUnhealthy)
+			if old == healthStateUnhealthy {
+				logger.WithError(err).Warningf("%s health check continues to fail. The server is at risk of termination.", HealthCheckEndpoint)
+			} else {
+				logger.WithError(err).Warningf("%s health check failed. The server will terminate if this continues to happen.", HealthCheckEndpoint)
+			}
+			return err
+		}
+	}
+
+	old := atomic.SwapInt32(sp.healthState, healthStateHealthy)
+	if old == healthStateUnhealthy {
+		logger.Infof("%s is healthy again.", HealthCheckEndpoint)
+	} else if old == healthStateFirstProbe {
+		logger.Infof("%s is reporting healthy.", HealthCheckEndpoint)
+	}
+	return nil
+}
+
 // NewAlwaysReadyHealthCheck indicates that the service is always healthy. Used for static HTTP servers.
 func NewAlwaysReadyHealthCheck() http.Handler {
 	return NewHealthCheck([]func(context.Context) error{})
@@ -18,6 +18,15 @@ var (
 	})
 )
 
+// ConfigFields describes the configuration keys read by this package.
+var ConfigFields = []config.Field{
+	{Key: "telemetry.reportingPeriod", Type: config.TypeDuration, Required: true},
+	{Key: "telemetry.traceSamplingFraction", Type: config.TypeFloat, Range: &config.Range{Min: 0, Max: 1}},
+	{Key: ConfigNameEnableMetrics, Type: config.TypeBool},
+	{Key: "telemetry.prometheus.endpoint", Type: config.TypeString},
+	{Key: configNameEnableConfigRollback, Type: config.TypeBool},
+}
+
 // Setup configures the telemetry for the server.
 func Setup(p Params, b Bindings) error {
 	bindings := []func(p Params, b Bindings) error{
@@ -28,7 +37,9 @@ func Setup(p Params, b Bindings) error {
 		//bindOpenCensusAgent,
 		//bindZpages,
 		//bindHelp,
-		//bindConfigz,
+		bindConfigz,
+		bindConfigHistory,
+		bindPprof,
 	}
 
 	for _, f := range bindings {
@@ -74,6 +85,9 @@ type Params interface {
 type Bindings interface {
 	TelemetryHandle(pattern string, handler http.Handler)
 	TelemetryHandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+	// HasAdminPort returns true if the telemetry handlers are served on an
+	// admin port rather than on the public port.
+	HasAdminPort() bool
 	AddCloser(c func())
 	AddCloserErr(c func() error)
 }
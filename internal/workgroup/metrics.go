@@ -0,0 +1,115 @@
+package workgroup
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+var (
+	keyPool = tag.MustNewKey("pool")
+
+	mSize       = stats.Int64("workgroup/size", "Number of goroutines in the work group", stats.UnitDimensionless)
+	mIterations = stats.Int64("workgroup/iterations", "Number of calls of the work function", stats.UnitDimensionless)
+	mDuration   = stats.Float64("workgroup/fn_duration", "Duration of a call of the work function", stats.UnitMilliseconds)
+	mErrors     = stats.Int64("workgroup/errors", "Number of calls of the work function which returned an error", stats.UnitDimensionless)
+	mPanics     = stats.Int64("workgroup/panics", "Number of calls of the work function which panicked", stats.UnitDimensionless)
+
+	sizeView = &view.View{
+		Measure:     mSize,
+		Name:        "workgroup/size",
+		Description: "Current number of goroutines in the work group",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+	iterationsView = &view.View{
+		Measure:     mIterations,
+		Name:        "workgroup/iterations",
+		Description: "Number of calls of the work function",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+	durationView = &view.View{
+		Measure:     mDuration,
+		Name:        "workgroup/fn_duration",
+		Description: "Distribution of the duration of calls of the work function",
+		Aggregation: view.Distribution(0.01, 0.05, 0.1, 0.3, 0.6, 0.8, 1, 2, 3, 4, 5, 6, 8, 10, 13, 16, 20, 25, 30, 40, 50, 65, 80, 100, 130, 160, 200, 250, 300, 400, 500, 650, 800, 1000, 2000, 5000, 10000, 20000, 50000, 100000),
+		TagKeys:     []tag.Key{keyPool},
+	}
+	errorsView = &view.View{
+		Measure:     mErrors,
+		Name:        "workgroup/errors",
+		Description: "Number of calls of the work function which returned an error",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+	panicsView = &view.View{
+		Measure:     mPanics,
+		Name:        "workgroup/panics",
+		Description: "Number of calls of the work function which panicked",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+
+	// OpenCensusViews are the views of the work group metrics, to be
+	// registered with Bindings.RegisterViews.
+	OpenCensusViews = []*view.View{
+		sizeView,
+		iterationsView,
+		durationView,
+		errorsView,
+		panicsView,
+	}
+)
+
+func recordSize(ctx context.Context, n int) {
+	stats.Record(ctx, mSize.M(int64(n)))
+}
+
+// call runs the work function once, recording its metrics and optionally a
+// span. A panic in the work function is recovered so the goroutine keeps
+// running.
+func (wg *WorkGroup) call(ctx context.Context) {
+	if wg.tracing {
+		var span *trace.Span
+		ctx, span = trace.StartSpan(ctx, "workgroup/"+wg.name)
+		defer span.End()
+	}
+
+	start := time.Now()
+	defer func() {
+		ms := float64(time.Since(start)) / float64(time.Millisecond)
+		stats.Record(ctx, mIterations.M(1), mDuration.M(ms))
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			stats.Record(ctx, mPanics.M(1))
+			if span := trace.FromContext(ctx); span != nil {
+				span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: fmt.Sprint(r)})
+			}
+			logger.WithFields(logrus.Fields{
+				"pool":  wg.name,
+				"panic": r,
+				"stack": string(debug.Stack()),
+			}).Error("work function panicked")
+		}
+	}()
+
+	if err := wg.fn(ctx); err != nil {
+		stats.Record(ctx, mErrors.M(1))
+		if span := trace.FromContext(ctx); span != nil {
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+		logger.WithFields(logrus.Fields{
+			"pool":  wg.name,
+			"error": err.Error(),
+		}).Debug("work function failed")
+	}
+}
@@ -0,0 +1,205 @@
+package workgroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrPipelineClosed is returned when an item is pushed to a closed Pipeline.
+var ErrPipelineClosed = errors.New("pipeline is closed")
+
+// StageFunc processes one item of a pipeline stage. It passes any number of
+// results to the next stage by calling emit, which blocks while the next stage
+// is full. emit must not be called after StageFunc returns. Items emitted by
+// the last stage are dropped.
+type StageFunc func(ctx context.Context, item interface{}, emit func(interface{})) error
+
+// ErrorHandler receives the items for which a stage returned an error or panicked.
+type ErrorHandler func(stage string, item interface{}, err error)
+
+// Stage describes one step of a Pipeline.
+type Stage struct {
+	// Name of the stage. The WorkGroup of the stage is named
+	// "<pipeline>/<stage>".
+	Name string
+	// Workers is the number of goroutines processing items of the stage. It
+	// must be at least 1, or the queued items could never be drained.
+	Workers int
+	// Buffer is the capacity of the channel feeding the stage. Producers
+	// block while it is full.
+	Buffer int
+	// Fn processes the items of the stage.
+	Fn StageFunc
+	// Options are applied to the WorkGroup of the stage.
+	Options []Option
+}
+
+// Pipeline joins stages through bounded channels, each stage processed by its
+// own WorkGroup.
+type Pipeline struct {
+	name    string
+	stages  []*stage
+	onError ErrorHandler
+	lock    sync.RWMutex
+	closed  bool
+}
+
+type stage struct {
+	Stage
+	in      chan interface{}
+	pending sync.WaitGroup
+	next    *stage
+	wg      *WorkGroup
+}
+
+// NewPipeline starts the stages, feeding each stage with the items emitted
+// by the stage before it. Errors are passed to onError; if it is nil they are
+// logged. It returns an error if a stage has less than one worker.
+func NewPipeline(name string, onError ErrorHandler, stages ...Stage) (*Pipeline, error) {
+	for _, s := range stages {
+		if s.Workers < 1 {
+			return nil, fmt.Errorf("stage %s of pipeline %s needs at least 1 worker, got %d", s.Name, name, s.Workers)
+		}
+	}
+	p := &Pipeline{
+		name:    name,
+		stages:  make([]*stage, len(stages)),
+		onError: onError,
+	}
+	if p.onError == nil {
+		p.onError = p.logError
+	}
+	for i := range stages {
+		p.stages[i] = &stage{
+			Stage: stages[i],
+			in:    make(chan interface{}, stages[i].Buffer),
+		}
+	}
+	// Start the last stage first, so every stage has a consumer once it runs.
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		s := p.stages[i]
+		if i+1 < len(p.stages) {
+			s.next = p.stages[i+1]
+		}
+		opts := append([]Option{WithName(name + "/" + s.Name)}, s.Options...)
+		s.wg = NewWorkGroupContext(s.Workers, p.worker(s), opts...)
+	}
+	return p, nil
+}
+
+// Push adds an item to the first stage. It blocks while the first stage is
+// full, and returns the error of ctx if ctx is done first.
+func (p *Pipeline) Push(ctx context.Context, item interface{}) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return ErrPipelineClosed
+	}
+	if len(p.stages) == 0 {
+		return nil
+	}
+	first := p.stages[0]
+	first.pending.Add(1)
+	select {
+	case first.in <- item:
+		return nil
+	case <-ctx.Done():
+		first.pending.Done()
+		return ctx.Err()
+	}
+}
+
+// Resize changes the number of goroutines of the named stage, and returns the
+// previous number. n must be at least 1.
+func (p *Pipeline) Resize(stageName string, n int) (int, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("stage %s of pipeline %s needs at least 1 worker, got %d", stageName, p.name, n)
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return 0, ErrPipelineClosed
+	}
+	for _, s := range p.stages {
+		if s.Name == stageName {
+			return s.wg.Resize(n), nil
+		}
+	}
+	return 0, fmt.Errorf("pipeline %s has no stage %s", p.name, stageName)
+}
+
+// Close stops accepting items and shuts the stages down in order. Each stage
+// finishes all of its queued items before the next stage is closed, so no
+// accepted item is lost.
+func (p *Pipeline) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	p.lock.Unlock()
+
+	for _, s := range p.stages {
+		close(s.in)
+		s.pending.Wait()
+		s.wg.Close()
+		logger.WithFields(logrus.Fields{
+			"pipeline": p.name,
+			"stage":    s.Name,
+		}).Debug("pipeline stage drained")
+	}
+}
+
+func (p *Pipeline) worker(s *stage) func(context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case item, ok := <-s.in:
+			if !ok {
+				// The stage is draining; idle until the WorkGroup is closed.
+				<-ctx.Done()
+				return nil
+			}
+			return p.process(ctx, s, item)
+		}
+	}
+}
+
+func (p *Pipeline) process(ctx context.Context, s *stage, item interface{}) error {
+	defer s.pending.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			p.onError(s.Name, item, fmt.Errorf("panic: %v", r))
+			// Let the WorkGroup count the panic.
+			panic(r)
+		}
+	}()
+
+	err := s.Fn(ctx, item, s.emit)
+	if err != nil {
+		p.onError(s.Name, item, err)
+	}
+	return err
+}
+
+func (s *stage) emit(item interface{}) {
+	if s.next == nil {
+		return
+	}
+	s.next.pending.Add(1)
+	s.next.in <- item
+}
+
+func (p *Pipeline) logError(stage string, item interface{}, err error) {
+	logger.WithFields(logrus.Fields{
+		"pipeline": p.name,
+		"stage":    stage,
+		"error":    err.Error(),
+	}).Warning("pipeline stage failed")
+}
@@ -0,0 +1,121 @@
+package workgroup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPipeline_DrainsInOrder(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		sum    int
+		failed []interface{}
+	)
+	errOdd := errors.New("odd")
+
+	p, err := NewPipeline("test", func(stage string, item interface{}, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if stage != "filter" || err != errOdd {
+			t.Errorf("unexpected error from %s: %v", stage, err)
+		}
+		failed = append(failed, item)
+	},
+		Stage{Name: "double", Workers: 3, Buffer: 1, Fn: func(_ context.Context, item interface{}, emit func(interface{})) error {
+			emit(item)
+			emit(item)
+			return nil
+		}},
+		Stage{Name: "filter", Workers: 2, Buffer: 1, Fn: func(_ context.Context, item interface{}, emit func(interface{})) error {
+			if item.(int)%2 == 1 {
+				return errOdd
+			}
+			emit(item)
+			return nil
+		}},
+		Stage{Name: "sum", Workers: 1, Fn: func(_ context.Context, item interface{}, emit func(interface{})) error {
+			lock.Lock()
+			defer lock.Unlock()
+			sum += item.(int)
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := p.Push(context.Background(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+
+	if sum != 2*2450 {
+		t.Errorf("expected sum %d, got %d", 2*2450, sum)
+	}
+	if len(failed) != 100 {
+		t.Errorf("expected 100 failed items, got %d", len(failed))
+	}
+	if err := p.Push(context.Background(), 0); err != ErrPipelineClosed {
+		t.Errorf("expected ErrPipelineClosed, got %v", err)
+	}
+}
+
+func TestPipeline_Backpressure(t *testing.T) {
+	release := make(chan struct{})
+	var processed int64
+	p, err := NewPipeline("backpressure", nil,
+		Stage{Name: "block", Workers: 1, Buffer: 1, Fn: func(_ context.Context, item interface{}, emit func(interface{})) error {
+			<-release
+			atomic.AddInt64(&processed, 1)
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One item is being processed and one is buffered, so the third push blocks.
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 2; i++ {
+		if err := p.Push(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	if err := p.Push(ctx, 2); err != context.Canceled {
+		t.Fatalf("expected push to a full pipeline to be cancelled, got %v", err)
+	}
+
+	close(release)
+	p.Close()
+	if n := atomic.LoadInt64(&processed); n != 2 {
+		t.Fatalf("expected 2 processed items, got %d", n)
+	}
+}
+
+func TestPipeline_RejectsNoWorkers(t *testing.T) {
+	fn := func(_ context.Context, item interface{}, emit func(interface{})) error { return nil }
+	if _, err := NewPipeline("none", nil, Stage{Name: "idle", Workers: 0, Fn: fn}); err == nil {
+		t.Fatal("expected a stage without workers to be rejected")
+	}
+
+	p, err := NewPipeline("resize", nil, Stage{Name: "work", Workers: 1, Buffer: 4, Fn: fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := p.Push(context.Background(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.Resize("work", 0); err == nil {
+		t.Fatal("expected resizing a stage to 0 workers to be rejected")
+	}
+	// Close would block forever if the stage had no workers left.
+	p.Close()
+}
@@ -0,0 +1,84 @@
+package workgroup
+
+import (
+	"context"
+	"math"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"siody.home/om-like/internal/config"
+)
+
+// WithRateLimit limits the calls of the work function, summed over all
+// goroutines of the group, to limit per second with bursts of up to burst
+// calls. A limit <= 0 disables rate limiting.
+func WithRateLimit(limit float64, burst int) Option {
+	return func(wg *WorkGroup) {
+		wg.SetRateLimit(limit, burst)
+	}
+}
+
+// WithRateLimitConfig reads the rate limit of the group from the keys
+// prefix.rate and prefix.burst of cfg. If cfg is Watchable, changes of these
+// keys are applied while the group is running.
+func WithRateLimitConfig(cfg config.View, prefix string) Option {
+	return func(wg *WorkGroup) {
+		// The limit is applied once all the options are set, so that it is
+		// logged with the name of the group.
+		wg.watchRateLimit = func() {
+			wg.applyRateLimitConfig(cfg, prefix)
+			wg.unwatch = config.Watch(cfg, prefix, func(_, v config.View) {
+				wg.applyRateLimitConfig(v, prefix)
+			})
+		}
+	}
+}
+
+func (wg *WorkGroup) applyRateLimitConfig(cfg config.View, prefix string) {
+	limit := cfg.GetFloat64(prefix + ".rate")
+	burst := cfg.GetInt(prefix + ".burst")
+	logger.WithFields(logrus.Fields{
+		"pool":  wg.name,
+		"rate":  limit,
+		"burst": burst,
+	}).Info("work group rate limit set")
+	wg.SetRateLimit(limit, burst)
+}
+
+// RateLimitConfigFields returns the schema of the keys read by
+// WithRateLimitConfig, for appmain.RegisterConfigFields.
+func RateLimitConfigFields(prefix string) []config.Field {
+	return []config.Field{
+		{Key: prefix + ".rate", Type: config.TypeFloat, Range: &config.Range{Min: 0, Max: math.MaxFloat64}},
+		{Key: prefix + ".burst", Type: config.TypeInt, Range: &config.Range{Min: 0, Max: math.MaxInt32}},
+	}
+}
+
+// SetRateLimit changes the rate limit of the group at runtime. See WithRateLimit.
+func (wg *WorkGroup) SetRateLimit(limit float64, burst int) {
+	if limit <= 0 {
+		wg.limiter.SetLimit(rate.Inf)
+		return
+	}
+	// A burst of zero would reject every call.
+	if burst < 1 {
+		burst = 1
+	}
+	wg.limiter.SetBurst(burst)
+	wg.limiter.SetLimit(rate.Limit(limit))
+}
+
+// RateLimit returns the current limit per second and burst of the group. A
+// limit <= 0 means calls are not limited.
+func (wg *WorkGroup) RateLimit() (limit float64, burst int) {
+	if wg.limiter.Limit() == rate.Inf {
+		return 0, wg.limiter.Burst()
+	}
+	return float64(wg.limiter.Limit()), wg.limiter.Burst()
+}
+
+// waitForToken blocks until the rate limit allows the next call, or the
+// goroutine is shut down.
+func (wg *WorkGroup) waitForToken(ctx context.Context) error {
+	return wg.limiter.Wait(ctx)
+}
@@ -3,28 +3,96 @@ package workgroup
 import (
 	"context"
 	"sync"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
+)
+
+var (
+	logger = logrus.WithFields(logrus.Fields{
+		"app":       "openmatch",
+		"component": "workgroup",
+	})
 )
 
+const defaultName = "unnamed"
+
 // WorkGroup resizable group of goroutine
 type WorkGroup struct {
-	fn      func()
-	cancels []func()
-	closed  []context.Context
-	lock    sync.Locker
+	name    string
+	tracing bool
+	fn      func(context.Context) error
+	ctx     context.Context
+	limiter *rate.Limiter
+	// watchRateLimit applies the rate limit configuration and subscribes to
+	// its changes, setting unwatch.
+	watchRateLimit func()
+	unwatch        func()
+	cancels        []func()
+	closed         []context.Context
+	lock           sync.Locker
+}
+
+// Option configures optional behaviour of a WorkGroup.
+type Option func(*WorkGroup)
+
+// WithName sets the pool name used to tag the metrics and spans of the WorkGroup.
+func WithName(name string) Option {
+	return func(wg *WorkGroup) {
+		wg.name = name
+	}
+}
+
+// WithTracing starts a trace span around each call of the work function.
+func WithTracing() Option {
+	return func(wg *WorkGroup) {
+		wg.tracing = true
+	}
 }
 
 // NewWorkGroup init a group of goroutine with size and function
-func NewWorkGroup(size int, fn func()) *WorkGroup {
+func NewWorkGroup(size int, fn func(), opts ...Option) *WorkGroup {
+	return NewWorkGroupContext(size, func(context.Context) error {
+		fn()
+		return nil
+	}, opts...)
+}
+
+// NewWorkGroupContext init a group of goroutine with size and a function which
+// receives the context of its goroutine. The context is cancelled when the
+// goroutine is shut down, and carries the span of the call if tracing is
+// enabled. Errors returned by fn are counted in the metrics of the group.
+func NewWorkGroupContext(size int, fn func(context.Context) error, opts ...Option) *WorkGroup {
 	wg := &WorkGroup{
+		name:    defaultName,
 		fn:      fn,
+		limiter: rate.NewLimiter(rate.Inf, 0),
 		cancels: make([]func(), 0),
 		closed:  make([]context.Context, 0),
 		lock:    new(sync.Mutex),
 	}
+	for _, opt := range opts {
+		opt(wg)
+	}
+	if wg.watchRateLimit != nil {
+		wg.watchRateLimit()
+	}
+	ctx, err := tag.New(context.Background(), tag.Upsert(keyPool, wg.name))
+	if err != nil {
+		logger.WithError(err).Warningf("cannot tag metrics of work group %s", wg.name)
+		ctx = context.Background()
+	}
+	wg.ctx = ctx
 	wg.Resize(size)
 	return wg
 }
 
+// Name returns the pool name of the group.
+func (wg *WorkGroup) Name() string {
+	return wg.name
+}
+
 func (wg *WorkGroup) runFN(ctx context.Context, closed func()) {
 	defer closed()
 	for {
@@ -32,19 +100,22 @@ func (wg *WorkGroup) runFN(ctx context.Context, closed func()) {
 		case <-ctx.Done():
 			return
 		default:
-			wg.fn()
+			if err := wg.waitForToken(ctx); err != nil {
+				continue
+			}
+			wg.call(ctx)
 		}
 	}
 }
 
 // Resize group size shutdown unnecessary goroutine or start more
 func (wg *WorkGroup) Resize(n int) (size int) {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
 	size = len(wg.cancels)
 	if n == size || n < 0 {
 		return
 	}
-	wg.lock.Lock()
-	defer wg.lock.Unlock()
 	for i := size; n > i; i++ {
 		wg.run()
 	}
@@ -54,20 +125,8 @@ func (wg *WorkGroup) Resize(n int) (size int) {
 	}
 	wg.cancels = wg.cancels[:n]
 	wg.closed = wg.closed[:n]
+	recordSize(wg.ctx, n)
 	return
-	/*if n > size {
-	//	wg.waitG.Add(n - size)
-	//	for i := 0; i < n-size; i++ {
-	//		wg.run()
-	//	}
-	//} else {
-	//	for i := n; i < size; i++ {
-	//		wg.stopI(i)
-	//		wg.joinI(i)
-	//	}
-	//	wg.cancels = wg.cancels[:n]
-	//	wg.closed = wg.closed[:n]
-	//}*/
 }
 
 func (wg *WorkGroup) joinI(i int) struct{} {
@@ -79,7 +138,7 @@ func (wg *WorkGroup) stopI(i int) {
 }
 
 func (wg *WorkGroup) run() {
-	ctx, cancel := context.WithCancel(context.TODO())
+	ctx, cancel := context.WithCancel(wg.ctx)
 	wg.cancels = append(wg.cancels, cancel)
 	closeCtx, closed := context.WithCancel(context.TODO())
 	wg.closed = append(wg.closed, closeCtx)
@@ -89,4 +148,7 @@ func (wg *WorkGroup) run() {
 // Close shutdown all goroutines and wait them exit
 func (wg *WorkGroup) Close() {
 	wg.Resize(0)
+	if wg.unwatch != nil {
+		wg.unwatch()
+	}
 }
@@ -0,0 +1,106 @@
+package workgroup
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"siody.home/om-like/internal/config"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkGroup_Resize(t *testing.T) {
+	var calls int64
+	wg := NewWorkGroup(2, func() {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(time.Millisecond)
+	})
+	defer wg.Close()
+
+	if size := wg.Resize(4); size != 2 {
+		t.Fatalf("expected previous size 2, got %d", size)
+	}
+	if size := wg.Resize(1); size != 4 {
+		t.Fatalf("expected previous size 4, got %d", size)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&calls) > 0 })
+	wg.Close()
+	if size := wg.Resize(0); size != 0 {
+		t.Fatalf("expected size 0 after close, got %d", size)
+	}
+}
+
+func TestWorkGroup_RecoversPanicsAndCountsErrors(t *testing.T) {
+	if err := view.Register(OpenCensusViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(OpenCensusViews...)
+
+	var calls int64
+	wg := NewWorkGroupContext(1, func(ctx context.Context) error {
+		switch atomic.AddInt64(&calls, 1) {
+		case 1:
+			panic("boom")
+		case 2:
+			return errors.New("failed")
+		}
+		<-ctx.Done()
+		return nil
+	}, WithName("test-panics"), WithTracing())
+
+	waitFor(t, func() bool { return atomic.LoadInt64(&calls) >= 3 })
+	wg.Close()
+
+	for _, name := range []string{panicsView.Name, errorsView.Name} {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0].Tags[0].Value != "test-panics" {
+			t.Fatalf("unexpected rows for %s: %v", name, rows)
+		}
+		if count := rows[0].Data.(*view.CountData).Value; count != 1 {
+			t.Fatalf("expected 1 for %s, got %d", name, count)
+		}
+	}
+}
+
+func TestWorkGroup_RateLimitConfig(t *testing.T) {
+	cfg := config.NewMemory()
+	cfg.Set("pool.rate", 20)
+	cfg.Set("pool.burst", 1)
+
+	var calls int64
+	wg := NewWorkGroup(4, func() {
+		atomic.AddInt64(&calls, 1)
+	}, WithRateLimitConfig(cfg, "pool"))
+	defer wg.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&calls); n > 10 {
+		t.Fatalf("expected at most 10 calls at 20/s, got %d", n)
+	}
+	if limit, burst := wg.RateLimit(); limit != 20 || burst != 1 {
+		t.Fatalf("unexpected rate limit %v/%d", limit, burst)
+	}
+
+	cfg.Set("pool.rate", 0)
+	waitFor(t, func() bool {
+		limit, _ := wg.RateLimit()
+		return limit == 0
+	})
+	before := atomic.LoadInt64(&calls)
+	waitFor(t, func() bool { return atomic.LoadInt64(&calls) > before+100 })
+}